@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// alertTemplateData is what user supplied templates, e.g. the body of a webhook, are executed
+// with. It's also the json representation of a batch of errors.
+type alertTemplateData struct {
+	Hostname  string      `json:"hostname"`
+	Timestamp time.Time   `json:"timestamp"`
+	Critical  int         `json:"critical"`
+	Warning   int         `json:"warning"`
+	Errors    []alertData `json:"errors"`
+	// Checks are the checks failing, e.g. "disk /" and "docker nginx", in the order they failed
+	Checks []string     `json:"-"`
+	Groups []alertGroup `json:"-"`
+}
+
+type alertData struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+	Check    string `json:"check,omitempty"`
+}
+
+// alertGroup is the errors with the same title
+type alertGroup struct {
+	Title    string
+	Severity string
+	Errors   []alertData
+}
+
+func makeAlertData(e verificationError) alertData {
+	return alertData{
+		Title:    e.title,
+		Message:  strings.TrimRight(e.message, "\n"),
+		Severity: e.severity,
+		Check:    e.check,
+	}
+}
+
+func makeAlertTemplateData(errors []verificationError, ts time.Time) alertTemplateData {
+	data := alertTemplateData{Hostname: hostname(), Timestamp: ts, Errors: []alertData{}}
+
+	seen := make(map[string]bool)
+	for _, e := range errors {
+		data.Errors = append(data.Errors, makeAlertData(e))
+
+		if e.severity == severityCritical {
+			data.Critical++
+		} else {
+			data.Warning++
+		}
+
+		if c := checkLabel(e); !seen[c] {
+			seen[c] = true
+			data.Checks = append(data.Checks, c)
+		}
+	}
+
+	for _, g := range groupByTitle(errors) {
+		group := alertGroup{Title: g.title, Severity: g.severity}
+		for _, e := range g.errors {
+			group.Errors = append(group.Errors, makeAlertData(e))
+		}
+		data.Groups = append(data.Groups, group)
+	}
+
+	return data
+}
+
+// checkLabel is the check of the error for people to read, e.g. "docker nginx" for docker:nginx
+func checkLabel(e verificationError) string {
+	return strings.Replace(e.key(), ":", " ", 1)
+}
+
+// alertTemplateFuncs are the functions available in the templates in addition to the builtin ones
+var alertTemplateFuncs = template.FuncMap{
+	// json encodes a value, e.g. {"text": {{json .Hostname}}} gives a properly quoted string
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+func parseAlertTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(alertTemplateFuncs).Parse(text)
+}
+
+func executeAlertTemplate(tmpl *template.Template, data alertTemplateData) (string, error) {
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
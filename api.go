@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiConfiguration is where the daemon listens for the silences and acknowledgments
+type apiConfiguration struct {
+	// Listen is the address to listen on, e.g. 127.0.0.1:9090
+	Listen string `json:"listen"`
+	// Token is required as a bearer token of the requests if set
+	Token string `json:"token"`
+}
+
+// apiAlert is an open alert as listed by the API
+type apiAlert struct {
+	Check string `json:"check"`
+	openAlert
+}
+
+// silenceRequest is a silence to add, ending after Duration unless it has an end
+type silenceRequest struct {
+	silence
+	Duration string `json:"duration"`
+}
+
+func (r silenceRequest) makeSilence(now time.Time) (silence, error) {
+	s := r.silence
+	if r.Duration != "" {
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			return s, fmt.Errorf("invalid duration '%s'", r.Duration)
+		}
+		if s.Starts.IsZero() {
+			s.Starts = now
+		}
+		s.Ends = s.Starts.Add(d)
+	}
+	return s, nil
+}
+
+// serveAPI serves the API until it fails, which is only logged for the checks to go on
+func serveAPI(config config) {
+	err := http.ListenAndServe(config.API.Listen, makeAPIHandler(config, time.Now))
+	log.Printf("Failed to serve the API: %s\n", fmt.Sprint(err))
+}
+
+// makeAPIHandler handles
+//
+//	GET    /api/alerts          the open alerts
+//	POST   /api/alerts/ack      acknowledges the alert of {"check": "docker:nginx"}
+//	GET    /api/silences        the silences in effect
+//	POST   /api/silences        adds a silence, e.g. {"type": "docker", "name": "jenkins", "duration": "2h"}
+//	DELETE /api/silences/<id>   ends a silence
+func makeAPIHandler(config config, now func() time.Time) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/alerts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		state, err := loadAlertState(config.alertStateFile())
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		alerts := []apiAlert{}
+		for k, a := range state.Alerts {
+			alerts = append(alerts, apiAlert{k, a})
+		}
+		sort.Slice(alerts, func(i, j int) bool { return alerts[i].Check < alerts[j].Check })
+		apiResponse(w, http.StatusOK, alerts)
+	})
+
+	mux.HandleFunc("/api/alerts/ack", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		var ack struct {
+			Check string `json:"check"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&ack)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = acknowledgeAlert(config, ack.Check)
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		apiResponse(w, http.StatusOK, ack)
+	})
+
+	mux.HandleFunc("/api/silences", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			silences, err := activeSilences(config, now())
+			if err != nil {
+				apiError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if silences == nil {
+				silences = []silence{}
+			}
+			apiResponse(w, http.StatusOK, silences)
+		case http.MethodPost:
+			var req silenceRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+			t := now()
+			s, err := req.makeSilence(t)
+			if err == nil {
+				s, err = addSilence(config, s, t)
+			}
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err)
+				return
+			}
+			apiResponse(w, http.StatusCreated, s)
+		default:
+			apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		}
+	})
+
+	mux.HandleFunc("/api/silences/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		err := expireSilence(config, strings.TrimPrefix(r.URL.Path, "/api/silences/"), now())
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.API != nil && config.API.Token != "" && !validToken(r, config.API.Token) {
+			apiError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// validToken tells if the request has the token, compared in constant time for the time taken
+// not to tell how much of it was right
+func validToken(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+func apiResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiResponse(w, status, map[string]string{"error": err.Error()})
+}
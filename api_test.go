@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{
+		Silences:   filepath.Join(dir, "silences.json"),
+		AlertState: filepath.Join(dir, "alert_state.json"),
+		API:        &apiConfiguration{Listen: "127.0.0.1:0", Token: "secret"},
+	}
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(makeAPIHandler(c, func() time.Time { return now }))
+	defer server.Close()
+
+	request := func(method, path, body string, v interface{}) int {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		assert.Nil(err, fmt.Sprint(err))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err, fmt.Sprint(err))
+		defer resp.Body.Close()
+		if v != nil {
+			assert.Nil(json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	var s silence
+	assert.Equal(http.StatusCreated, request("POST", "/api/silences", `{"type": "docker", "name": "jenkins", "duration": "2h", "comment": "upgrading"}`, &s))
+	assert.Equal(now.Add(2*time.Hour), s.Ends)
+	assert.Equal("upgrading", s.Comment)
+	assert.Equal(http.StatusBadRequest, request("POST", "/api/silences", `{"duration": "2h"}`, nil))
+
+	var silences []silence
+	assert.Equal(http.StatusOK, request("GET", "/api/silences", "", &silences))
+	assert.Equal([]silence{s}, silences)
+
+	assert.Equal(http.StatusNoContent, request("DELETE", "/api/silences/"+s.ID, "", nil))
+	assert.Equal(http.StatusNotFound, request("DELETE", "/api/silences/"+s.ID, "", nil))
+	assert.Equal(http.StatusOK, request("GET", "/api/silences", "", &silences))
+	assert.Equal(0, len(silences))
+
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+	updateAlerts(c, errors, now, nil)
+
+	var alerts []apiAlert
+	assert.Equal(http.StatusOK, request("GET", "/api/alerts", "", &alerts))
+	assert.Equal(1, len(alerts))
+	assert.Equal("docker:nginx", alerts[0].Check)
+	assert.False(alerts[0].Acknowledged)
+
+	assert.Equal(http.StatusOK, request("POST", "/api/alerts/ack", `{"check": "docker:nginx"}`, nil))
+	assert.Equal(http.StatusNotFound, request("POST", "/api/alerts/ack", `{"check": "docker:elk"}`, nil))
+	assert.Equal(http.StatusOK, request("GET", "/api/alerts", "", &alerts))
+	assert.True(alerts[0].Acknowledged)
+
+	assert.Equal(http.StatusMethodNotAllowed, request("PUT", "/api/alerts", "", nil))
+
+	resp, err := http.Get(server.URL + "/api/alerts")
+	assert.Nil(err, fmt.Sprint(err))
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest("GET", server.URL+"/api/alerts", nil)
+	assert.Nil(err, fmt.Sprint(err))
+	req.Header.Set("Authorization", "Bearer secre")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(err, fmt.Sprint(err))
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode, "a prefix of the token")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// runCommand runs the subcommands managing silences and acknowledgments:
+//
+//	ismonitor silence add -type docker -name jenkins -for 2h -comment "upgrading"
+//	ismonitor silence list
+//	ismonitor silence expire <id>
+//	ismonitor ack docker:nginx
+func runCommand(config config, args []string, now time.Time, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command")
+	}
+
+	switch args[0] {
+	case "ack":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: ismonitor ack <check>")
+		}
+		return acknowledgeAlert(config, args[1])
+	case "silence":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: ismonitor silence add|list|expire")
+		}
+		return runSilenceCommand(config, args[1], args[2:], now, w)
+	default:
+		return fmt.Errorf("unknown command '%s'", args[0])
+	}
+}
+
+func runSilenceCommand(config config, command string, args []string, now time.Time, w io.Writer) error {
+	switch command {
+	case "add":
+		flags := flag.NewFlagSet("silence add", flag.ContinueOnError)
+		flags.SetOutput(w)
+		var req silenceRequest
+		flags.StringVar(&req.Type, "type", "", "type of the checks to silence, e.g. docker")
+		flags.StringVar(&req.Name, "name", "", "name of the checks to silence, e.g. jenkins")
+		flags.StringVar(&req.Host, "host", "", "host to silence")
+		flags.StringVar(&req.Comment, "comment", "", "why the checks are silenced")
+		flags.StringVar(&req.Duration, "for", "1h", "how long to silence the checks")
+		err := flags.Parse(args)
+		if err != nil {
+			return err
+		}
+
+		s, err := req.makeSilence(now)
+		if err == nil {
+			s, err = addSilence(config, s, now)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, s.ID)
+		return nil
+	case "list":
+		silences, err := activeSilences(config, now)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tNAME\tHOST\tENDS\tCOMMENT")
+		for _, s := range silences {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, orAny(s.Type), orAny(s.Name), orAny(s.Host), s.Ends.Format("2006-01-02 15:04"), s.Comment)
+		}
+		return tw.Flush()
+	case "expire":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: ismonitor silence expire <id>")
+		}
+		return expireSilence(config, args[0], now)
+	default:
+		return fmt.Errorf("unknown silence command '%s'", command)
+	}
+}
+
+func orAny(pattern string) string {
+	if pattern == "" {
+		return "*"
+	}
+	return pattern
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// failingAlerts returns the open alerts that are notified as failing, that is those firing that
+// failed their latest run and are neither acknowledged nor silenced. The ones recovering or that
+// nobody is told about can't hide the errors of their dependents.
+func failingAlerts(open map[string]openAlert, isSilenced func(check string) bool) map[string]openAlert {
+	failing := make(map[string]openAlert)
+	for k, a := range open {
+		if a.firing() && a.Passes == 0 && !a.Acknowledged && !isSilenced(k) {
+			failing[k] = a
+		}
+	}
+	return failing
+}
+
+// suppressDependents drops the errors of the checks that depend on a failing check, directly or
+// through other checks, and lists them with the first error of the check at the root instead.
+// Besides the checks of the errors the checks of the open alerts fail, see failingAlerts, which
+// includes the checks run by other jobs; the errors depending on those are dropped without being
+// listed anywhere.
+func suppressDependents(errors []verificationError, open map[string]openAlert) []verificationError {
+	failing := make(map[string][]string)
+	for k, a := range open {
+		failing[k] = a.DependsOn
+	}
+	for _, e := range errors {
+		if _, ok := failing[e.key()]; !ok || len(e.dependsOn) > 0 {
+			failing[e.key()] = e.dependsOn
+		}
+	}
+
+	dependents := make(map[string][]string)
+	suppressed := make(map[string]bool)
+	for _, e := range errors {
+		k := e.key()
+		if suppressed[k] {
+			continue
+		}
+		root := rootCause(failing, k, map[string]bool{k: true})
+		// in a cycle of dependencies the check the others were suppressed under stays
+		if root != k && !suppressed[root] {
+			suppressed[k] = true
+			dependents[root] = append(dependents[root], k)
+		}
+	}
+
+	var notified []verificationError
+	summarized := make(map[string]bool)
+	for _, e := range errors {
+		k := e.key()
+		if suppressed[k] {
+			continue
+		}
+		if d := dependents[k]; len(d) > 0 && !summarized[k] {
+			e.message += fmt.Sprintf("Also failing because of it: %s\n", strings.Join(d, ", "))
+			summarized[k] = true
+		}
+		notified = append(notified, e)
+	}
+
+	return notified
+}
+
+// rootCause follows the failing dependencies of the check to the first that depends on nothing
+// failing, ignoring dependencies back to a check already passed through
+func rootCause(failing map[string][]string, check string, visited map[string]bool) string {
+	for _, d := range failing[check] {
+		if _, ok := failing[d]; !ok || visited[d] {
+			continue
+		}
+		visited[d] = true
+		return rootCause(failing, d, visited)
+	}
+	return check
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuppressDependents(t *testing.T) {
+	assert := assert.New(t)
+
+	elk := verificationError{title: "Docker verification error", message: "Docker container 'elk' is not running\n", severity: severityCritical, check: "docker:elk"}
+	errors := []verificationError{
+		{title: "ELK verification error", message: "Failed to make elk request\n", check: "elk:errors", dependsOn: []string{"docker:elk"}},
+		elk,
+		{title: "ELK verification error", message: "Failed to make elk request\n", check: "elk:latency", dependsOn: []string{"docker:elk"}},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", check: "disk:/"},
+		{title: "Loki verification error", message: "Too many errors\n", check: "loki:errors", dependsOn: []string{"docker:loki"}},
+	}
+
+	notified := suppressDependents(errors, nil)
+	assert.Equal(3, len(notified))
+	assert.Equal("docker:elk", notified[0].check)
+	assert.Equal("Docker container 'elk' is not running\nAlso failing because of it: elk:errors, elk:latency\n", notified[0].message)
+	assert.Equal(errors[3:], notified[1:], "dependencies not failing don't matter")
+	assert.Equal(elk, errors[1], "the errors are left as they are")
+
+	// through other checks
+	errors = []verificationError{
+		{title: "ELK verification error", message: "Too many errors\n", check: "elk:errors", dependsOn: []string{"elk:up"}},
+		{title: "ELK verification error", message: "Failed to make elk request\n", check: "elk:up", dependsOn: []string{"docker:elk"}},
+		elk,
+	}
+	notified = suppressDependents(errors, nil)
+	assert.Equal(1, len(notified))
+	assert.Equal("Docker container 'elk' is not running\nAlso failing because of it: elk:errors, elk:up\n", notified[0].message)
+
+	// in a cycle one of the checks is kept
+	errors = []verificationError{
+		{title: "A", message: "a\n", check: "a", dependsOn: []string{"b"}},
+		{title: "B", message: "b\n", check: "b", dependsOn: []string{"a"}},
+	}
+	notified = suppressDependents(errors, nil)
+	assert.Equal(1, len(notified))
+	assert.Equal("b\nAlso failing because of it: a\n", notified[0].message)
+}
+
+func TestUpdateAlertsDependencies(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{AlertState: filepath.Join(dir, "alert_state.json"), History: filepath.Join(dir, "history.jsonl")}
+	t0 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	errors := func() []verificationError {
+		return []verificationError{
+			{title: "Docker verification error", message: "Docker container 'elk' is not running\n", severity: severityCritical, check: "docker:elk", thresholds: thresholdOptions{FailAfter: 2}},
+			{title: "ELK verification error", message: "Failed to make elk request\n", check: "elk:errors", dependsOn: []string{"docker:elk"}},
+		}
+	}
+
+	// a check held back by fail_after holds back its dependents too
+	notified, _ := updateAlerts(c, errors(), t0, nil)
+	assert.Equal(0, len(notified))
+
+	notified, _ = updateAlerts(c, errors(), t0.Add(time.Minute), nil)
+	assert.Equal(1, len(notified))
+	assert.Equal("docker:elk", notified[0].check)
+	assert.Equal("Docker container 'elk' is not running\nAlso failing because of it: elk:errors\n", notified[0].message)
+
+	// the checks of other jobs, run on other schedules, are found in the alert state
+	notified, _ = updateAlerts(c, errors()[:1], t0.Add(2*time.Minute), func(k string) bool { return k == "docker:elk" })
+	assert.Equal(1, len(notified))
+	notified, _ = updateAlerts(c, errors()[1:], t0.Add(3*time.Minute), func(k string) bool { return k == "elk:errors" })
+	assert.Equal(0, len(notified))
+
+	// as are their dependencies
+	loki := []verificationError{{title: "Loki verification error", message: "Too many errors\n", check: "loki:errors", dependsOn: []string{"elk:errors"}}}
+	notified, _ = updateAlerts(c, loki, t0.Add(4*time.Minute), func(k string) bool { return k == "loki:errors" })
+	assert.Equal(0, len(notified))
+
+	// once the dependency has recovered the check is notified on its own
+	updateAlerts(c, nil, t0.Add(5*time.Minute), func(k string) bool { return k == "docker:elk" })
+	notified, _ = updateAlerts(c, errors()[1:], t0.Add(6*time.Minute), func(k string) bool { return k == "elk:errors" })
+	assert.Equal(1, len(notified))
+	assert.Equal("elk:errors", notified[0].check)
+}
+
+func TestUpdateAlertsDependencyRoots(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{AlertState: filepath.Join(dir, "alert_state.json"), History: filepath.Join(dir, "history.jsonl")}
+	t0 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	elk := []verificationError{{title: "Docker verification error", message: "Docker container 'elk' is not running\n", severity: severityCritical, check: "docker:elk", thresholds: thresholdOptions{RecoverAfter: 2}}}
+	dependent := func() []verificationError {
+		return []verificationError{{title: "ELK verification error", message: "Failed to make elk request\n", check: "elk:errors", dependsOn: []string{"docker:elk"}}}
+	}
+	isElk := func(k string) bool { return k == "docker:elk" }
+	isDependent := func(k string) bool { return k == "elk:errors" }
+
+	notified, _ := updateAlerts(c, elk, t0, isElk)
+	assert.Equal(1, len(notified))
+	notified, _ = updateAlerts(c, dependent(), t0.Add(time.Minute), isDependent)
+	assert.Equal(0, len(notified))
+
+	// a root waiting out recover_after no longer fails, so its dependents are notified
+	_, recovered := updateAlerts(c, nil, t0.Add(2*time.Minute), isElk)
+	assert.Equal(0, len(recovered))
+	notified, _ = updateAlerts(c, dependent(), t0.Add(3*time.Minute), isDependent)
+	assert.Equal(1, len(notified))
+	assert.Equal("elk:errors", notified[0].check)
+
+	// as are those of an acknowledged root, which isn't notified itself
+	updateAlerts(c, elk, t0.Add(4*time.Minute), isElk)
+	assert.Nil(acknowledgeAlert(c, "docker:elk"))
+	notified, _ = updateAlerts(c, append(elk, dependent()...), t0.Add(5*time.Minute), nil)
+	assert.Equal(1, len(notified))
+	assert.Equal("elk:errors", notified[0].check)
+	assert.Equal("Failed to make elk request\n", notified[0].message)
+	notified, _ = updateAlerts(c, dependent(), t0.Add(6*time.Minute), isDependent)
+	assert.Equal(1, len(notified))
+}
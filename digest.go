@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// digestConfiguration is the periodic report of what has failed since the previous one
+type digestConfiguration struct {
+	// CronSchedule is when the digest is sent in daemon mode. Run from cron it's sent with -digest.
+	CronSchedule string `json:"cron_schedule"`
+	// SMTP is where the digest is mailed, defaults to the smtp configuration or that of the
+	// first email notifier. Without any the digest is written to stdout.
+	SMTP *smtpConfiguration `json:"smtp"`
+}
+
+// defaultHistory is where the outages are recorded unless configured
+const defaultHistory = "history.jsonl"
+
+// maxDigestOutages is the number of longest outages listed in the digest
+const maxDigestOutages = 5
+
+// historyRecord is a line of the history, either an outage of a check or a digest that has
+// been sent, covering Started to Ended
+type historyRecord struct {
+	Check    string    `json:"check,omitempty"`
+	Title    string    `json:"title,omitempty"`
+	Severity string    `json:"severity,omitempty"`
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended"`
+	Failures int       `json:"failures,omitempty"`
+	Digest   bool      `json:"digest,omitempty"`
+}
+
+func (r historyRecord) duration() time.Duration {
+	return r.Ended.Sub(r.Started)
+}
+
+type digestJob struct {
+	config *config
+}
+
+func (t digestJob) Run() {
+	err := sendDigest(*t.config, time.Now())
+	if err != nil {
+		log.Printf("Failed to send digest: %s\n", fmt.Sprint(err))
+	}
+}
+
+func (c config) historyFile() string {
+	if c.History != "" {
+		return c.History
+	}
+	return defaultHistory
+}
+
+func validateDigestConfiguration(config config) error {
+	if config.Digest.CronSchedule != "" {
+		if _, err := cron.Parse(config.Digest.CronSchedule); err != nil {
+			return fmt.Errorf("digest has an invalid cron_schedule: %s", fmt.Sprint(err))
+		}
+	}
+	if config.Digest.SMTP != nil {
+		if err := validateSMTPConfiguration(*config.Digest.SMTP); err != nil {
+			return fmt.Errorf("digest smtp: %s", fmt.Sprint(err))
+		}
+	}
+	return nil
+}
+
+// appendHistory appends the records to the history file, a line of json each
+func appendHistory(file string, records []historyRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	b, err := encodeHistory(records)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	// a single write so that lines appended at the same time by a run and a digest aren't mixed
+	_, err = f.Write(b)
+
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// writeHistory replaces the history file with the records, through a temporary file like
+// writeJSONFile
+func writeHistory(file string, records []historyRecord) error {
+	b, err := encodeHistory(records)
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0640)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func encodeHistory(records []historyRecord) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, r := range records {
+		err := enc.Encode(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// pruneHistory drops the records that ended before the last digest, which has reported them
+func pruneHistory(history []historyRecord) []historyRecord {
+	var last time.Time
+	for _, r := range history {
+		if r.Digest {
+			last = r.Ended
+		}
+	}
+
+	var records []historyRecord
+	for _, r := range history {
+		if !r.Ended.Before(last) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func readHistory(file string) ([]historyRecord, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var r historyRecord
+		err := json.Unmarshal(s.Bytes(), &r)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse history: %s", fmt.Sprint(err))
+		}
+		records = append(records, r)
+	}
+
+	return records, s.Err()
+}
+
+// digest is what the digest report is made from
+type digest struct {
+	Hostname string
+	Since    time.Time
+	Until    time.Time
+	// Checks are the checks that have failed, the one down the longest first
+	Checks []digestCheck
+	// Longest are the longest outages that ended since the previous digest
+	Longest []historyRecord
+	// Open are the alerts still open, the oldest first
+	Open []historyRecord
+}
+
+type digestCheck struct {
+	Check    string
+	Title    string
+	Outages  int
+	Failures int
+	// Downtime is the time the check has failed since the previous digest
+	Downtime time.Duration
+}
+
+// makeDigest summarizes the outages ended since the previous digest, or since the history
+// started if there is none, and the alerts still open
+func makeDigest(history []historyRecord, state *alertState, now time.Time) digest {
+	d := digest{Hostname: hostname(), Until: now}
+
+	digested := false
+	var outages []historyRecord
+	for _, r := range history {
+		if r.Digest {
+			d.Since = r.Ended
+			digested = true
+			outages = nil
+			continue
+		}
+		outages = append(outages, r)
+	}
+
+	for k, a := range state.Alerts {
+		// the checks that haven't failed fail_after runs yet have no alert yet
+		if !a.firing() {
+			continue
+		}
+		d.Open = append(d.Open, historyRecord{Check: k, Title: a.Title, Severity: a.Severity, Started: a.FirstSeen, Ended: now, Failures: a.Failures})
+	}
+	sort.Slice(d.Open, func(i, j int) bool { return d.Open[i].Started.Before(d.Open[j].Started) })
+
+	if !digested {
+		// the first digest covers everything there is
+		d.Since = now
+		for _, r := range append(append([]historyRecord(nil), outages...), d.Open...) {
+			if r.Started.Before(d.Since) {
+				d.Since = r.Started
+			}
+		}
+	}
+
+	checks := make(map[string]*digestCheck)
+	for _, r := range append(append([]historyRecord(nil), outages...), d.Open...) {
+		c, ok := checks[r.Check]
+		if !ok {
+			c = &digestCheck{Check: r.Check, Title: r.Title}
+			checks[r.Check] = c
+		}
+		c.Outages++
+		c.Failures += r.Failures
+
+		started := r.Started
+		if started.Before(d.Since) {
+			started = d.Since
+		}
+		c.Downtime += r.Ended.Sub(started)
+	}
+	for _, c := range checks {
+		d.Checks = append(d.Checks, *c)
+	}
+	sort.Slice(d.Checks, func(i, j int) bool {
+		if d.Checks[i].Downtime != d.Checks[j].Downtime {
+			return d.Checks[i].Downtime > d.Checks[j].Downtime
+		}
+		return d.Checks[i].Check < d.Checks[j].Check
+	})
+
+	sort.SliceStable(outages, func(i, j int) bool { return outages[i].duration() > outages[j].duration() })
+	if len(outages) > maxDigestOutages {
+		outages = outages[:maxDigestOutages]
+	}
+	d.Longest = outages
+
+	return d
+}
+
+// formatDigest renders the digest as text
+func formatDigest(d digest) string {
+	const timeFormat = "2006-01-02 15:04 MST"
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "ismonitor digest for %s\n%s - %s\n\n", d.Hostname, d.Since.Format(timeFormat), d.Until.Format(timeFormat))
+
+	if len(d.Checks) == 0 {
+		b.WriteString("Nothing has failed.\n")
+		return b.String()
+	}
+
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(&b, "Open problems (%d)\n", len(d.Open))
+	for _, r := range d.Open {
+		fmt.Fprintf(w, "   %s\t%s\tfailing for %s\tsince %s\t%d failed %s\n",
+			checkLabel(verificationError{check: r.Check}), r.Severity, formatDuration(r.duration()), r.Started.Format(timeFormat),
+			r.Failures, pluralize(r.Failures, "run", "runs"))
+	}
+	w.Flush()
+
+	b.WriteString("\nFailures by check\n")
+	for _, c := range d.Checks {
+		fmt.Fprintf(w, "   %s\t%d %s\t%d failed %s\tdown %s\n",
+			checkLabel(verificationError{check: c.Check}), c.Outages, pluralize(c.Outages, "outage", "outages"),
+			c.Failures, pluralize(c.Failures, "run", "runs"), formatDuration(c.Downtime))
+	}
+	w.Flush()
+
+	if len(d.Longest) > 0 {
+		b.WriteString("\nLongest outages\n")
+		for _, r := range d.Longest {
+			fmt.Fprintf(w, "   %s\t%s\t%s - %s\n",
+				formatDuration(r.duration()), checkLabel(verificationError{check: r.Check}), r.Started.Format(timeFormat), r.Ended.Format(timeFormat))
+		}
+		w.Flush()
+	}
+
+	return b.String()
+}
+
+// formatDuration formats the duration rounded to minutes, e.g. 1h5m
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Minute {
+		return "<1m"
+	}
+	return strings.TrimSuffix(d.String(), "0s")
+}
+
+// digestSMTP returns where to mail the digest, nil if it's to be written to stdout
+func digestSMTP(config config) (*smtpConfiguration, error) {
+	if config.Digest != nil && config.Digest.SMTP != nil {
+		return config.Digest.SMTP, nil
+	}
+	if config.SMTP != nil {
+		return config.SMTP, nil
+	}
+	for _, c := range config.Notifiers {
+		if c.Type == "email" && c.enabled() {
+			var smtpConfig smtpConfiguration
+			err := c.settings(&smtpConfig)
+			if err != nil {
+				return nil, err
+			}
+			return &smtpConfig, nil
+		}
+	}
+	return nil, nil
+}
+
+// sendDigest reports what has failed since the previous digest and records that it has been sent
+func sendDigest(config config, now time.Time) error {
+	history, err := readHistory(config.historyFile())
+	if err != nil {
+		return err
+	}
+
+	state, err := loadAlertState(config.alertStateFile())
+	if err != nil {
+		return fmt.Errorf("Failed to read alert state: %s", fmt.Sprint(err))
+	}
+
+	d := makeDigest(history, state, now)
+	text := formatDigest(d)
+
+	smtpConfig, err := digestSMTP(config)
+	if err != nil {
+		return err
+	}
+	if smtpConfig != nil {
+		title := fmt.Sprintf("[ismonitor] %s: digest, %d failing %s, %d open",
+			d.Hostname, len(d.Checks), pluralize(len(d.Checks), "check", "checks"), len(d.Open))
+		err = deliverMail(makeMailSender(*smtpConfig), *smtpConfig, nil, now, title, []mailPart{{"text/plain; charset=\"utf-8\"", text}}, nil)
+	} else {
+		_, err = fmt.Fprint(os.Stdout, text)
+	}
+	if err != nil {
+		return err
+	}
+
+	return recordDigest(config, historyRecord{Started: d.Since, Ended: now, Digest: true})
+}
+
+// recordDigest appends the record of a digest to the history and drops the outages the
+// previous digest has reported. The history is appended to by the runs while they hold the
+// lock of the alert state, so the same lock is held to not lose their records.
+func recordDigest(config config, digest historyRecord) error {
+	unlock, err := lockFile(config.alertStateFile())
+	if err != nil {
+		return fmt.Errorf("Failed to lock alert state: %s", fmt.Sprint(err))
+	}
+	defer unlock()
+
+	history, err := readHistory(config.historyFile())
+	if err != nil {
+		return err
+	}
+
+	return writeHistory(config.historyFile(), append(pruneHistory(history), digest))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	t0 := time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)
+	now := t0.Add(24 * time.Hour)
+
+	history := []historyRecord{
+		{Check: "disk:/", Title: "Disk usage verification error", Severity: severityWarning, Started: t0.Add(-2 * time.Hour), Ended: t0.Add(-time.Hour), Failures: 12},
+		{Started: t0.Add(-24 * time.Hour), Ended: t0, Digest: true},
+		// started before the previous digest, only the time after counts as downtime
+		{Check: "disk:/", Title: "Disk usage verification error", Severity: severityWarning, Started: t0.Add(-10 * time.Minute), Ended: t0.Add(20 * time.Minute), Failures: 6},
+		{Check: "docker:nginx", Title: "Docker verification error", Severity: severityCritical, Started: t0.Add(2 * time.Hour), Ended: t0.Add(3 * time.Hour), Failures: 12},
+		{Check: "disk:/", Title: "Disk usage verification error", Severity: severityWarning, Started: t0.Add(5 * time.Hour), Ended: t0.Add(5*time.Hour + 5*time.Minute), Failures: 1},
+	}
+
+	state := newAlertState()
+	state.Alerts["load"] = openAlert{Title: "Load average verification error", Severity: severityWarning, FirstSeen: now.Add(-30 * time.Minute), LastSeen: now, Failures: 6}
+	state.Alerts["disk:/var"] = openAlert{Title: "Disk usage verification error", Severity: severityWarning, FirstSeen: now.Add(-10 * time.Minute), LastSeen: now, Failures: 2, FailAfter: 3}
+
+	d := makeDigest(history, state, now)
+	assert.Equal(t0, d.Since)
+	assert.Equal(now, d.Until)
+
+	assert.Equal([]digestCheck{
+		{Check: "docker:nginx", Title: "Docker verification error", Outages: 1, Failures: 12, Downtime: time.Hour},
+		{Check: "load", Title: "Load average verification error", Outages: 1, Failures: 6, Downtime: 30 * time.Minute},
+		{Check: "disk:/", Title: "Disk usage verification error", Outages: 2, Failures: 7, Downtime: 25 * time.Minute},
+	}, d.Checks)
+
+	assert.Equal(3, len(d.Longest))
+	assert.Equal("docker:nginx", d.Longest[0].Check)
+	assert.Equal(30*time.Minute, d.Longest[1].duration())
+
+	assert.Equal(1, len(d.Open))
+	assert.Equal("load", d.Open[0].Check)
+
+	text := formatDigest(d)
+	assert.Contains(text, "ismonitor digest for "+hostname()+"\n2018-03-01 08:00 UTC - 2018-03-02 08:00 UTC\n")
+	assert.Contains(text, "Open problems (1)\n   load  warning  failing for 30m  since 2018-03-02 07:30 UTC  6 failed runs\n")
+	assert.Contains(text, "Failures by check\n   docker nginx  1 outage   12 failed runs  down 1h0m\n")
+	assert.Contains(text, "   disk /        2 outages  7 failed runs   down 25m\n")
+	assert.Contains(text, "Longest outages\n   1h0m  docker nginx  2018-03-01 10:00 UTC - 2018-03-01 11:00 UTC\n")
+
+	// without a previous digest everything in the history is included
+	d = makeDigest(history[:1], newAlertState(), now)
+	assert.Equal(t0.Add(-2*time.Hour), d.Since)
+	assert.Equal(1, len(d.Checks))
+
+	d = makeDigest(nil, newAlertState(), now)
+	assert.Equal(0, len(d.Checks))
+	assert.Contains(formatDigest(d), "Nothing has failed.\n")
+}
+
+func TestSendDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{AlertState: filepath.Join(dir, "alert_state.json"), History: filepath.Join(dir, "history.jsonl")}
+
+	t0 := time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+	updateAlerts(c, errors, t0, nil)
+	updateAlerts(c, errors, t0.Add(5*time.Minute), nil)
+	updateAlerts(c, nil, t0.Add(10*time.Minute), nil)
+
+	history, err := readHistory(c.History)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(history))
+	assert.Equal(2, history[0].Failures)
+	assert.Equal(10*time.Minute, history[0].duration())
+
+	stdout := os.Stdout
+	os.Stdout, err = os.Create(filepath.Join(dir, "stdout"))
+	assert.Nil(err, fmt.Sprint(err))
+	err = sendDigest(c, t0.Add(time.Hour))
+	os.Stdout.Close()
+	os.Stdout = stdout
+	assert.Nil(err, fmt.Sprint(err))
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.True(strings.Contains(string(b), "docker nginx  1 outage  2 failed runs  down 10m"), string(b))
+
+	// the next digest starts where the previous ended
+	history, err = readHistory(c.History)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(2, len(history))
+	assert.True(history[1].Digest)
+
+	d := makeDigest(history, newAlertState(), t0.Add(2*time.Hour))
+	assert.Equal(t0.Add(time.Hour), d.Since)
+	assert.Equal(0, len(d.Checks))
+
+	// the outages the previous digest has reported are dropped with the next
+	updateAlerts(c, errors, t0.Add(2*time.Hour), nil)
+	updateAlerts(c, nil, t0.Add(2*time.Hour+5*time.Minute), nil)
+
+	os.Stdout, err = os.Create(filepath.Join(dir, "stdout"))
+	assert.Nil(err, fmt.Sprint(err))
+	err = sendDigest(c, t0.Add(3*time.Hour))
+	os.Stdout.Close()
+	os.Stdout = stdout
+	assert.Nil(err, fmt.Sprint(err))
+
+	history, err = readHistory(c.History)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(3, len(history))
+	assert.Equal(historyRecord{Started: t0, Ended: t0.Add(time.Hour), Digest: true}, history[0])
+	assert.Equal(t0.Add(2*time.Hour), history[1].Started)
+	assert.Equal(historyRecord{Started: t0.Add(time.Hour), Ended: t0.Add(3 * time.Hour), Digest: true}, history[2])
+}
+
+func TestPruneHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	t0 := time.Date(2018, 3, 1, 8, 0, 0, 0, time.UTC)
+	history := []historyRecord{
+		{Check: "load", Started: t0.Add(-3 * time.Hour), Ended: t0.Add(-2 * time.Hour)},
+		{Started: t0.Add(-24 * time.Hour), Ended: t0.Add(-time.Hour), Digest: true},
+		{Check: "disk:/", Started: t0.Add(-2 * time.Hour), Ended: t0.Add(-30 * time.Minute)},
+		{Started: t0.Add(-time.Hour), Ended: t0, Digest: true},
+		{Check: "docker:nginx", Started: t0.Add(time.Hour), Ended: t0.Add(2 * time.Hour)},
+	}
+
+	assert.Equal(history[3:], pruneHistory(history))
+	assert.Equal(history[:1], pruneHistory(history[:1]), "nothing is dropped before the first digest")
+	assert.Nil(pruneHistory(nil))
+}
+
+func TestValidateDigestConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	c := config{Digest: &digestConfiguration{CronSchedule: "0 0 8 * * *"}}
+	assert.Nil(validateConfig(c))
+
+	c.Digest.CronSchedule = "every morning"
+	assert.NotNil(validateConfig(c))
+
+	c.Digest = &digestConfiguration{SMTP: &smtpConfiguration{Host: "host"}}
+	assert.NotNil(validateConfig(c), "smtp without to")
+}
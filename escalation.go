@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// escalationTier names the notifiers told about an alert once it has been open for After, e.g.
+// 30m, without being acknowledged
+type escalationTier struct {
+	After     string   `json:"after"`
+	Notifiers []string `json:"notifiers"`
+}
+
+// makeEscalations returns how long an alert has to be open before each notifier in the
+// escalation tiers is told about it
+func makeEscalations(config config) (map[string]time.Duration, error) {
+	names := make(map[string]bool)
+	for _, c := range config.Notifiers {
+		names[c.name()] = true
+	}
+
+	escalations := make(map[string]time.Duration)
+	for i, tier := range config.Escalation {
+		after := time.Duration(0)
+		if tier.After != "" {
+			var err error
+			after, err = time.ParseDuration(tier.After)
+			if err != nil || after < 0 {
+				return nil, fmt.Errorf("escalation tier %d has an invalid after '%s'", i+1, tier.After)
+			}
+		}
+		if len(tier.Notifiers) == 0 {
+			return nil, fmt.Errorf("escalation tier %d has no notifiers", i+1)
+		}
+
+		for _, name := range tier.Notifiers {
+			if !names[name] {
+				return nil, fmt.Errorf("escalation tier %d: no notifier named '%s'", i+1, name)
+			}
+			if _, ok := escalations[name]; ok {
+				return nil, fmt.Errorf("escalation tier %d: notifier '%s' is already in another tier", i+1, name)
+			}
+			escalations[name] = after
+		}
+	}
+
+	return escalations, nil
+}
+
+// escalatedNotifier is a notifier of an escalation tier. It's only told about the alerts open
+// for at least after that haven't been acknowledged, and about the recoveries of the alerts
+// it has been told about, which are recorded in the alert state under its name.
+type escalatedNotifier struct {
+	notifier
+	name  string
+	after time.Duration
+	state string
+	now   func() time.Time
+}
+
+func (n escalatedNotifier) notify(errors []verificationError) error {
+	now := n.now()
+
+	var escalated []verificationError
+	for _, e := range errors {
+		if !e.acknowledged && n.reached(e, now) {
+			escalated = append(escalated, e)
+		}
+	}
+
+	if len(escalated) == 0 {
+		return nil
+	}
+
+	// only the errors that got through a throttled notifier have been told about
+	sent := escalated
+	var err error
+	if f, ok := n.notifier.(filteringNotifier); ok {
+		sent, err = f.notifySent(escalated)
+	} else {
+		err = n.notifier.notify(escalated)
+	}
+	if err != nil {
+		return err
+	}
+
+	return recordNotified(n.state, n.name, sent)
+}
+
+func (n escalatedNotifier) notifyRecovered(recovered []verificationError) error {
+	r, ok := n.notifier.(recoveryNotifier)
+	if !ok {
+		return nil
+	}
+
+	var escalated []verificationError
+	for _, e := range recovered {
+		if containsString(e.notified, n.name) {
+			escalated = append(escalated, e)
+		}
+	}
+
+	if len(escalated) == 0 {
+		return nil
+	}
+	return r.notifyRecovered(escalated)
+}
+
+// reached tells if the alert of the error has been open long enough for the tier, errors not
+// from the alert state having no time to go by are always sent
+func (n escalatedNotifier) reached(e verificationError, now time.Time) bool {
+	return e.since.IsZero() || now.Sub(e.since) >= n.after
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeEscalations(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	err := json.Unmarshal([]byte(`{
+  "notifiers": [
+    {"type": "file", "name": "ops", "path": "alerts.txt"},
+    {"type": "stdout", "name": "on call"},
+    {"type": "jsonl"}
+  ],
+  "escalation": [
+    {"notifiers": ["ops"]},
+    {"after": "30m", "notifiers": ["on call"]}
+  ]
+}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(3, len(notifiers))
+	assert.Equal(time.Duration(0), notifiers[0].notifier.(escalatedNotifier).after)
+	assert.Equal(30*time.Minute, notifiers[1].notifier.(escalatedNotifier).after)
+	_, ok := notifiers[2].notifier.(escalatedNotifier)
+	assert.False(ok, "notifiers in no tier are told about everything")
+
+	c.Escalation = []escalationTier{{After: "30m", Notifiers: []string{"pager"}}}
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "unknown notifier")
+
+	c.Escalation = []escalationTier{{Notifiers: []string{"ops"}}, {After: "1h", Notifiers: []string{"ops"}}}
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "notifier in two tiers")
+
+	c.Escalation = []escalationTier{{After: "soon", Notifiers: []string{"ops"}}}
+	_, err = makeNotifiers(c)
+	assert.NotNil(err)
+
+	_, err = makeNotifiers(config{Escalation: []escalationTier{{Notifiers: []string{"email"}}}})
+	assert.NotNil(err, "escalation without notifiers")
+}
+
+func TestEscalatedNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+	c := config{AlertState: filepath.Join(dir, "alert_state.json")}
+
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := &mockNotifier{}
+	n := escalatedNotifier{m, "on call", 30 * time.Minute, c.alertStateFile(), func() time.Time { return now }}
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Docker verification error", message: "Docker container 'elk' is not running\n", severity: severityCritical, check: "docker:elk"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+	}
+	updateAlerts(c, errors[:2], now.Add(-time.Hour), nil)
+	errors, _ = updateAlerts(c, errors, now.Add(-10*time.Minute), nil)
+	errors[1].acknowledged = true
+
+	err = n.notify(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(errors[:1], m.errors)
+
+	// the recovery of the alert acknowledged before the tier was told about it isn't sent
+	_, recovered := updateAlerts(c, nil, now, nil)
+	assert.Equal(3, len(recovered))
+	err = n.notifyRecovered(recovered)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(m.recovered))
+	assert.Equal("docker:nginx", m.recovered[0].check)
+
+	m.errors = nil
+	now = now.Add(20 * time.Minute)
+	err = n.notify(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal([]verificationError{errors[0], errors[2]}, m.errors)
+}
+
+func TestEscalatedThrottledNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+	c := config{AlertState: filepath.Join(dir, "alert_state.json")}
+
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := &mockNotifier{}
+	throttled, err := makeThrottledNotifier(notifierConfiguration{Type: "stdout", RateLimit: &rateLimit{Max: 1, Period: "1h"}}, m, filepath.Join(dir, "notifier_state.json"))
+	assert.Nil(err, fmt.Sprint(err))
+	n := escalatedNotifier{throttled, "on call", 0, c.alertStateFile(), func() time.Time { return now }}
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+	}
+	errors, _ = updateAlerts(c, errors, now, nil)
+
+	// the alert held back by the rate limit isn't recorded as told about
+	err = n.notify(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(2, len(m.errors))
+	assert.Equal("docker:nginx", m.errors[0].check)
+	assert.Equal("Alerts suppressed", m.errors[1].title)
+
+	state, err := loadAlertState(c.AlertState)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal([]string{"on call"}, state.Alerts["docker:nginx"].Notified)
+	assert.Equal(0, len(state.Alerts["disk:/"].Notified))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// thresholdOptions hold back the errors of a check until it has failed FailAfter runs in a row,
+// and its recovery until it has passed RecoverAfter runs in a row
+type thresholdOptions struct {
+	FailAfter    int            `json:"fail_after"`
+	RecoverAfter int            `json:"recover_after"`
+	Flapping     *flapDetection `json:"flapping"`
+}
+
+// flapDetection marks a check as flapping when it has changed between failing and passing at
+// least Changes times within Window, e.g. 4 times within 1h
+type flapDetection struct {
+	Changes int    `json:"changes"`
+	Window  string `json:"window"`
+}
+
+// flapState is how a check with flap detection has changed
+type flapState struct {
+	Detection flapDetection `json:"detection"`
+	Failing   bool          `json:"failing"`
+	Changes   []time.Time   `json:"changes"`
+	Flapping  bool          `json:"flapping"`
+}
+
+func (t thresholdOptions) empty() bool {
+	return t.FailAfter == 0 && t.RecoverAfter == 0 && t.Flapping == nil
+}
+
+func validateThresholdOptions(t thresholdOptions) error {
+	if t.FailAfter < 0 || t.RecoverAfter < 0 {
+		return fmt.Errorf("fail_after and recover_after can't be negative")
+	}
+	if f := t.Flapping; f != nil {
+		if f.Changes < 2 {
+			return fmt.Errorf("flapping requires at least 2 changes")
+		}
+		d, err := time.ParseDuration(f.Window)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("flapping has an invalid window '%s'", f.Window)
+		}
+	}
+	return nil
+}
+
+// applyThresholds sets the thresholds configured by check type, e.g. docker, or check, e.g.
+// docker:nginx, for the errors of the checks without any of their own
+func applyThresholds(thresholds map[string]thresholdOptions, errors []verificationError) []verificationError {
+	for i, e := range errors {
+		if !e.thresholds.empty() {
+			continue
+		}
+		checkType, _ := splitCheck(e.key())
+		if t, ok := thresholds[e.key()]; ok {
+			errors[i].thresholds = t
+		} else if t, ok := thresholds[checkType]; ok {
+			errors[i].thresholds = t
+		}
+	}
+	return errors
+}
+
+// detectFlapping records the changes of the checks with flap detection in scope, all checks if
+// nil. The errors of the checks flapping are marked as pending, and a notice is returned for each
+// check that started to.
+func (s *alertState) detectFlapping(errors []verificationError, now time.Time, scope func(string) bool) []verificationError {
+	if s.Flaps == nil {
+		s.Flaps = make(map[string]flapState)
+	}
+
+	failing := make(map[string]verificationError)
+	for _, e := range errors {
+		if _, ok := failing[e.key()]; ok {
+			continue
+		}
+		failing[e.key()] = e
+		if e.thresholds.Flapping != nil {
+			f := s.Flaps[e.key()]
+			f.Detection = *e.thresholds.Flapping
+			s.Flaps[e.key()] = f
+		}
+	}
+
+	var notices []verificationError
+	for k, f := range s.Flaps {
+		_, isFailing := failing[k]
+		if !isFailing && scope != nil && !scope(k) {
+			continue
+		}
+		if isFailing != f.Failing {
+			f.Changes = append(f.Changes, now)
+			f.Failing = isFailing
+		}
+
+		window, _ := time.ParseDuration(f.Detection.Window)
+		var changes []time.Time
+		for _, t := range f.Changes {
+			if now.Sub(t) < window {
+				changes = append(changes, t)
+			}
+		}
+		f.Changes = changes
+
+		wasFlapping := f.Flapping
+		f.Flapping = len(f.Changes) >= f.Detection.Changes
+		if f.Flapping && !wasFlapping {
+			notices = append(notices, verificationError{
+				title:    "Check flapping",
+				message:  fmt.Sprintf("%s is flapping, it has changed %d times within %s. It's not notified until it has settled.\n", k, len(f.Changes), f.Detection.Window),
+				severity: severityWarning,
+				check:    k,
+			})
+		}
+
+		if len(f.Changes) == 0 && !f.Failing {
+			delete(s.Flaps, k)
+		} else {
+			s.Flaps[k] = f
+		}
+	}
+
+	for i, e := range errors {
+		if s.Flaps[e.key()].Flapping {
+			errors[i].pending = true
+		}
+	}
+
+	sort.Slice(notices, func(i, j int) bool { return notices[i].check < notices[j].check })
+	return notices
+}
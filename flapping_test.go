@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	t0 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	run := func(state *alertState, errors []verificationError, i int) ([]verificationError, []verificationError) {
+		now := t0.Add(time.Duration(i) * time.Minute)
+		state.detectFlapping(errors, now, nil)
+		recovered, _ := state.update(errors, now, nil)
+		var notified []verificationError
+		for _, e := range errors {
+			if !e.pending {
+				notified = append(notified, e)
+			}
+		}
+		return notified, recovered
+	}
+	load := func() []verificationError {
+		return []verificationError{{title: "Load average verification error", message: "Load average is 5.2\n", severity: severityWarning, check: "load",
+			thresholds: thresholdOptions{FailAfter: 3, RecoverAfter: 2}}}
+	}
+
+	state := newAlertState()
+	notified, _ := run(state, load(), 0)
+	assert.Equal(0, len(notified))
+	notified, _ = run(state, load(), 1)
+	assert.Equal(0, len(notified))
+
+	// passing before fail_after starts over without a recovery
+	_, recovered := run(state, nil, 2)
+	assert.Equal(0, len(recovered))
+	assert.Equal(0, len(state.Alerts))
+
+	for i := 3; i < 5; i++ {
+		notified, _ = run(state, load(), i)
+		assert.Equal(0, len(notified))
+	}
+	notified, _ = run(state, load(), 5)
+	assert.Equal(1, len(notified))
+	assert.Equal(t0.Add(3*time.Minute), notified[0].since)
+
+	// a single pass doesn't recover it
+	_, recovered = run(state, nil, 6)
+	assert.Equal(0, len(recovered))
+	notified, _ = run(state, load(), 7)
+	assert.Equal(1, len(notified), "it's still firing")
+	_, recovered = run(state, nil, 8)
+	assert.Equal(0, len(recovered))
+	_, recovered = run(state, nil, 9)
+	assert.Equal(1, len(recovered))
+	assert.Equal(0, len(state.Alerts))
+}
+
+func TestFlapping(t *testing.T) {
+	assert := assert.New(t)
+
+	t0 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	errors := func() []verificationError {
+		return []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx",
+			thresholds: thresholdOptions{Flapping: &flapDetection{Changes: 4, Window: "10m"}}}}
+	}
+
+	state := newAlertState()
+	for i := 0; i < 3; i++ {
+		var e []verificationError
+		if i%2 == 0 {
+			e = errors()
+		}
+		notices := state.detectFlapping(e, t0.Add(time.Duration(i)*time.Minute), nil)
+		assert.Equal(0, len(notices))
+		for _, err := range e {
+			assert.False(err.pending)
+		}
+	}
+
+	// the fourth change within 10 minutes
+	notices := state.detectFlapping(nil, t0.Add(3*time.Minute), nil)
+	assert.Equal(1, len(notices))
+	assert.Equal("docker:nginx", notices[0].check)
+	assert.Equal("docker:nginx is flapping, it has changed 4 times within 10m. It's not notified until it has settled.\n", notices[0].message)
+
+	// notified once, and the errors held back while it flaps
+	e := errors()
+	notices = state.detectFlapping(e, t0.Add(4*time.Minute), nil)
+	assert.Equal(0, len(notices))
+	assert.True(e[0].pending)
+
+	// until it has settled
+	e = errors()
+	state.detectFlapping(e, t0.Add(10*time.Minute), nil)
+	assert.True(e[0].pending, "still 4 changes within 10 minutes")
+	e = errors()
+	state.detectFlapping(e, t0.Add(11*time.Minute), nil)
+	assert.False(e[0].pending)
+	assert.False(state.Flaps["docker:nginx"].Flapping)
+
+	state.detectFlapping(nil, t0.Add(15*time.Minute), nil)
+	state.detectFlapping(nil, t0.Add(30*time.Minute), nil)
+	assert.Equal(0, len(state.Flaps))
+}
+
+func TestApplyThresholds(t *testing.T) {
+	assert := assert.New(t)
+
+	thresholds := map[string]thresholdOptions{
+		"docker":       {FailAfter: 2},
+		"docker:nginx": {FailAfter: 5},
+	}
+	errors := applyThresholds(thresholds, []verificationError{
+		{check: "docker:nginx"},
+		{check: "docker:elk"},
+		{check: "load"},
+		{check: "docker:jenkins", thresholds: thresholdOptions{RecoverAfter: 3}},
+	})
+	assert.Equal(5, errors[0].thresholds.FailAfter)
+	assert.Equal(2, errors[1].thresholds.FailAfter)
+	assert.True(errors[2].thresholds.empty())
+	assert.Equal(thresholdOptions{RecoverAfter: 3}, errors[3].thresholds, "the check's own thresholds")
+
+	assert.NotNil(validateThresholdOptions(thresholdOptions{FailAfter: -1}))
+	assert.NotNil(validateThresholdOptions(thresholdOptions{Flapping: &flapDetection{Changes: 1, Window: "1h"}}))
+	assert.NotNil(validateThresholdOptions(thresholdOptions{Flapping: &flapDetection{Changes: 4}}))
+	assert.Nil(validateThresholdOptions(thresholdOptions{FailAfter: 3, Flapping: &flapDetection{Changes: 4, Window: "1h"}}))
+}
+
+func TestUpdateAlertsFlapping(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{AlertState: filepath.Join(dir, "alert_state.json"), History: filepath.Join(dir, "history.jsonl")}
+	t0 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	errors := func() []verificationError {
+		return []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx",
+			thresholds: thresholdOptions{Flapping: &flapDetection{Changes: 2, Window: "1h"}}}}
+	}
+
+	notified, _ := updateAlerts(c, errors(), t0, nil)
+	assert.Equal(1, len(notified))
+
+	// the recovery is the second change
+	notified, recovered := updateAlerts(c, nil, t0.Add(time.Minute), nil)
+	assert.Equal(1, len(notified))
+	assert.Equal("Check flapping", notified[0].title)
+	assert.Equal(0, len(recovered))
+
+	notified, _ = updateAlerts(c, errors(), t0.Add(2*time.Minute), nil)
+	assert.Equal(0, len(notified))
+}
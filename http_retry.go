@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxRetries is how many times a request to a webhook is retried unless configured
+const defaultMaxRetries = 3
+
+// maxRetryWait is the longest a Retry-After header is waited for, for a notifier never to hold
+// up the others for long
+const maxRetryWait = 30 * time.Second
+
+// notifierClient is the client of the notifiers, with a timeout for a hung endpoint not to
+// block the reporting
+var notifierClient = &http.Client{Timeout: 30 * time.Second}
+
+// sendWithRetry sends the body to url. Rate limited (429) and server error (5xx) responses
+// are retried, waiting as long as a Retry-After header says, up to maxRetryWait, or otherwise
+// doubling the wait for each retry.
+func sendWithRetry(method string, url string, headers map[string]string, body []byte, maxRetries int, wait time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := notifierClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !retryable || attempt >= maxRetries {
+			return fmt.Errorf("webhook responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(res)))
+		}
+
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			time.Sleep(retryAfter(s))
+		} else {
+			time.Sleep(wait << uint(attempt))
+		}
+	}
+}
+
+// retryAfter is how long to wait for a Retry-After of seconds
+func retryAfter(seconds int) time.Duration {
+	if seconds < 0 {
+		return 0
+	}
+	if seconds > int(maxRetryWait/time.Second) {
+		return maxRetryWait
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A minimal reader of systemd journal files as described in
+// https://systemd.io/JOURNAL_FILE_FORMAT/. It walks the objects of a file in the order they
+// were written and returns the entry objects with their fields. The hash tables and entry
+// arrays used for lookups are not needed for that and are ignored.
+
+const journalSignature = "LPKSHHRH"
+
+const (
+	journalObjectData  = 1
+	journalObjectEntry = 3
+)
+
+const (
+	journalIncompatibleCompact = 16
+
+	journalObjectCompressedXZ   = 1
+	journalObjectCompressedLZ4  = 2
+	journalObjectCompressedZSTD = 4
+)
+
+const (
+	journalHeaderMinSize    = 144
+	journalObjectHeaderSize = 16
+	journalEntryItemsOffset = 64
+	// journalTailEntryRealtimeOffset is where the header has the time of the last entry, in
+	// headers of at least journalTailEntryRealtimeOffset+8 bytes
+	journalTailEntryRealtimeOffset = 192
+)
+
+type journalEntry struct {
+	realtime time.Time
+	fields   map[string]string
+}
+
+type journalReader struct {
+	r       io.ReaderAt
+	size    int64
+	compact bool
+	// data caches the payload of the data objects, which are shared between entries
+	data map[uint64]string
+}
+
+// readJournalFile returns the entries of the journal file written at or after since
+func readJournalFile(file string, since time.Time) ([]journalEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return readJournal(f, fi.Size(), since)
+}
+
+func readJournal(r io.ReaderAt, size int64, since time.Time) ([]journalEntry, error) {
+	header := make([]byte, journalHeaderMinSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read journal header: %s", fmt.Sprint(err))
+	}
+	if string(header[0:8]) != journalSignature {
+		return nil, fmt.Errorf("Not a journal file")
+	}
+
+	incompatibleFlags := binary.LittleEndian.Uint32(header[12:16])
+	headerSize := binary.LittleEndian.Uint64(header[88:96])
+	tailObjectOffset := binary.LittleEndian.Uint64(header[136:144])
+
+	// an archived file that ended before since has nothing to read
+	if headerSize >= journalTailEntryRealtimeOffset+8 {
+		b := make([]byte, 8)
+		_, err := r.ReadAt(b, journalTailEntryRealtimeOffset)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read journal header: %s", fmt.Sprint(err))
+		}
+		tail := binary.LittleEndian.Uint64(b)
+		if tail != 0 && time.Unix(0, int64(tail)*int64(time.Microsecond)).Before(since) {
+			return nil, nil
+		}
+	}
+
+	j := journalReader{
+		r:       r,
+		size:    size,
+		compact: incompatibleFlags&journalIncompatibleCompact != 0,
+		data:    make(map[uint64]string),
+	}
+
+	var entries []journalEntry
+
+	// files that are still being written may end with an incomplete object, stop at the first
+	// object that can't be read
+	offset := headerSize
+	for offset != 0 && offset <= tailObjectOffset {
+		objectType, _, objectSize, err := j.readObjectHeader(offset)
+		if err != nil || objectSize < journalObjectHeaderSize {
+			break
+		}
+
+		if objectType == journalObjectEntry {
+			entry, err := j.readEntry(offset, objectSize, since)
+			if err != nil {
+				break
+			}
+			if entry != nil {
+				entries = append(entries, *entry)
+			}
+		}
+
+		offset += (objectSize + 7) &^ 7
+	}
+
+	return entries, nil
+}
+
+func (j *journalReader) readObjectHeader(offset uint64) (byte, byte, uint64, error) {
+	b := make([]byte, journalObjectHeaderSize)
+	_, err := j.r.ReadAt(b, int64(offset))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	size := binary.LittleEndian.Uint64(b[8:16])
+	if int64(offset+size) > j.size {
+		return 0, 0, 0, fmt.Errorf("Object at %d exceeds the file", offset)
+	}
+
+	return b[0], b[1], size, nil
+}
+
+// readEntry returns the entry at offset, or nil if it was written before since
+func (j *journalReader) readEntry(offset uint64, size uint64, since time.Time) (*journalEntry, error) {
+	b := make([]byte, size)
+	_, err := j.r.ReadAt(b, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	if size < journalEntryItemsOffset {
+		return nil, fmt.Errorf("Entry at %d is too small", offset)
+	}
+
+	realtime := binary.LittleEndian.Uint64(b[24:32])
+	ts := time.Unix(0, int64(realtime)*int64(time.Microsecond))
+	if ts.Before(since) {
+		return nil, nil
+	}
+
+	itemSize := uint64(16)
+	if j.compact {
+		itemSize = 4
+	}
+
+	entry := journalEntry{realtime: ts, fields: make(map[string]string)}
+	for p := uint64(journalEntryItemsOffset); p+itemSize <= size; p += itemSize {
+		var dataOffset uint64
+		if j.compact {
+			dataOffset = uint64(binary.LittleEndian.Uint32(b[p : p+4]))
+		} else {
+			dataOffset = binary.LittleEndian.Uint64(b[p : p+8])
+		}
+
+		payload, ok, err := j.readData(dataOffset)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		i := bytes.IndexByte([]byte(payload), '=')
+		if i < 0 {
+			continue
+		}
+		entry.fields[payload[:i]] = payload[i+1:]
+	}
+
+	return &entry, nil
+}
+
+// readData returns the payload of the data object at offset, e.g. "MESSAGE=Started nginx". Compressed
+// payloads, which journald only uses for large fields, can't be read and are reported as not ok.
+func (j *journalReader) readData(offset uint64) (string, bool, error) {
+	if payload, ok := j.data[offset]; ok {
+		return payload, true, nil
+	}
+
+	objectType, flags, size, err := j.readObjectHeader(offset)
+	if err != nil {
+		return "", false, err
+	}
+	if objectType != journalObjectData {
+		return "", false, fmt.Errorf("Expected data object at %d but was type %d", offset, objectType)
+	}
+	if flags&(journalObjectCompressedXZ|journalObjectCompressedLZ4|journalObjectCompressedZSTD) != 0 {
+		return "", false, nil
+	}
+
+	payloadOffset := uint64(64)
+	if j.compact {
+		payloadOffset = 72
+	}
+	if size < payloadOffset {
+		return "", false, fmt.Errorf("Data object at %d is too small", offset)
+	}
+
+	b := make([]byte, size-payloadOffset)
+	_, err = j.r.ReadAt(b, int64(offset+payloadOffset))
+	if err != nil {
+		return "", false, err
+	}
+
+	j.data[offset] = string(b)
+	return string(b), true, nil
+}
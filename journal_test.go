@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testJournalEntry struct {
+	realtime time.Time
+	fields   []string
+}
+
+// writeTestJournal writes a journal file with the given entries. Only what readJournal looks at
+// is filled in, i.e. the header, the data objects and the entry objects. Data objects are shared
+// between entries as journald does.
+func writeTestJournal(t *testing.T, file string, compact bool, entries []testJournalEntry) {
+	const headerSize = 272
+
+	var objects bytes.Buffer
+	offset := func() uint64 { return uint64(headerSize + objects.Len()) }
+	align := func() {
+		for objects.Len()%8 != 0 {
+			objects.WriteByte(0)
+		}
+	}
+	le64 := func(v uint64) {
+		binary.Write(&objects, binary.LittleEndian, v)
+	}
+	le32 := func(v uint32) {
+		binary.Write(&objects, binary.LittleEndian, v)
+	}
+
+	var tail, tailRealtime uint64
+	data := make(map[string]uint64)
+
+	for _, e := range entries {
+		var items []uint64
+		for _, f := range e.fields {
+			if o, ok := data[f]; ok {
+				items = append(items, o)
+				continue
+			}
+
+			payloadOffset := 64
+			if compact {
+				payloadOffset = 72
+			}
+
+			tail = offset()
+			data[f] = tail
+			items = append(items, tail)
+
+			objects.WriteByte(journalObjectData)
+			objects.Write(make([]byte, 7))
+			le64(uint64(payloadOffset + len(f)))
+			objects.Write(make([]byte, payloadOffset-16))
+			objects.WriteString(f)
+			align()
+		}
+
+		itemSize := 16
+		if compact {
+			itemSize = 4
+		}
+
+		tail = offset()
+		tailRealtime = uint64(e.realtime.UnixNano() / int64(time.Microsecond))
+		objects.WriteByte(journalObjectEntry)
+		objects.Write(make([]byte, 7))
+		le64(uint64(journalEntryItemsOffset + len(items)*itemSize))
+		le64(1)                                                       // seqnum
+		le64(uint64(e.realtime.UnixNano() / int64(time.Microsecond))) // realtime
+		le64(0)                                                       // monotonic
+		objects.Write(make([]byte, 16))                               // boot id
+		le64(0)                                                       // xor hash
+		for _, item := range items {
+			if compact {
+				le32(uint32(item))
+			} else {
+				le64(item)
+				le64(0) // hash
+			}
+		}
+		align()
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, journalSignature)
+	if compact {
+		binary.LittleEndian.PutUint32(header[12:16], journalIncompatibleCompact)
+	}
+	binary.LittleEndian.PutUint64(header[88:96], headerSize)
+	binary.LittleEndian.PutUint64(header[96:104], uint64(objects.Len()))
+	binary.LittleEndian.PutUint64(header[136:144], tail)
+	binary.LittleEndian.PutUint64(header[192:200], tailRealtime)
+
+	err := ioutil.WriteFile(file, append(header, objects.Bytes()...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadJournalFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1457344800, 0)
+	entries := []testJournalEntry{
+		{now.Add(-time.Hour), []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=6", "MESSAGE=Started nginx"}},
+		{now.Add(-time.Minute), []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=3", "MESSAGE=Failed to bind to port 80"}},
+		{now, []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=6", "MESSAGE=Started nginx", "FOO=a=b"}},
+	}
+
+	for _, compact := range []bool{false, true} {
+		file := filepath.Join(dir, fmt.Sprintf("system-%v.journal", compact))
+		writeTestJournal(t, file, compact, entries)
+
+		read, err := readJournalFile(file, now.Add(-5*time.Minute))
+		assert.Nil(err, fmt.Sprint(err))
+		assert.Equal(2, len(read))
+		assert.Equal(now.Add(-time.Minute), read[0].realtime)
+		assert.Equal(map[string]string{"_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "3", "MESSAGE": "Failed to bind to port 80"}, read[0].fields)
+		assert.Equal(map[string]string{"_SYSTEMD_UNIT": "nginx.service", "PRIORITY": "6", "MESSAGE": "Started nginx", "FOO": "a=b"}, read[1].fields)
+
+		read, err = readJournalFile(file, time.Time{})
+		assert.Nil(err, fmt.Sprint(err))
+		assert.Equal(3, len(read))
+	}
+
+	// the objects of a file that ended before since, as the header tells, aren't read
+	file := filepath.Join(dir, "system@archived.journal")
+	writeTestJournal(t, file, false, entries)
+	b, err := ioutil.ReadFile(file)
+	assert.Nil(err, fmt.Sprint(err))
+	binary.LittleEndian.PutUint64(b[192:200], uint64(now.Add(-2*time.Hour).UnixNano()/int64(time.Microsecond)))
+	assert.Nil(ioutil.WriteFile(file, b, 0644))
+
+	read, err := readJournalFile(file, now.Add(-time.Hour))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(0, len(read))
+}
+
+func TestReadJournalFileTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1457344800, 0)
+	file := filepath.Join(dir, "system.journal")
+	writeTestJournal(t, file, false, []testJournalEntry{
+		{now, []string{"MESSAGE=first"}},
+		{now, []string{"MESSAGE=second"}},
+	})
+
+	// an incomplete last object, as when reading a file being written, is ignored
+	b, err := ioutil.ReadFile(file)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Nil(ioutil.WriteFile(file, b[:len(b)-8], 0644))
+
+	read, err := readJournalFile(file, time.Time{})
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(read))
+	assert.Equal("first", read[0].fields["MESSAGE"])
+
+	assert.Nil(ioutil.WriteFile(file, []byte("not a journal file, just some text in a file"), 0644))
+	_, err = readJournalFile(file, time.Time{})
+	assert.NotNil(err)
+}
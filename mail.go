@@ -1,47 +1,232 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"strings"
 	"time"
 )
 
 type mailSender func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
 
-func sendEmail(senderFunc mailSender, smtpConfig smtpConfiguration, ts time.Time, errors []verificationError) error {
-	// set up possible authentication
-	var auth smtp.Auth
-	if smtpConfig.Auth != nil {
-		a := *smtpConfig.Auth
-		auth = smtp.PlainAuth(
-			"",
-			a.Username,
-			a.Password,
-			smtpConfig.Host,
-		)
-	} else {
-		auth = nil
+// mailHeader is a header of a mail. The headers are kept in a list to always be written in the
+// same order.
+type mailHeader struct {
+	key   string
+	value string
+}
+
+// defaultMailSubject tells which host is failing and what, e.g.
+// "[ismonitor] web01: 2 critical, 1 warning — disk /, docker nginx"
+const defaultMailSubject = `[ismonitor] {{.Hostname}}: ` +
+	`{{if .Critical}}{{.Critical}} critical{{end}}{{if and .Critical .Warning}}, {{end}}{{if .Warning}}{{.Warning}} warning{{end}}` +
+	` — {{join .Checks ", "}}`
+
+// maxMailSubjectLength is the length longer subjects are cut to
+const maxMailSubjectLength = 200
+
+type mailPart struct {
+	contentType string
+	content     string
+}
+
+// defaultRecoveryMailSubject is the subject of the mail telling that checks have recovered
+const defaultRecoveryMailSubject = `[ismonitor] {{.Hostname}}: recovered — {{join .Checks ", "}}`
+
+func sendEmail(senderFunc mailSender, smtpConfig smtpConfiguration, threads *mailThreads, ts time.Time, errors []verificationError) error {
+	data := makeAlertTemplateData(errors, ts)
+
+	title, err := makeMailSubject(smtpConfig.Subject, defaultMailSubject, data)
+	if err != nil {
+		return err
 	}
 
+	parts, err := makeMailParts(smtpConfig.Body, data, errors)
+	if err != nil {
+		return err
+	}
+
+	return deliverMail(senderFunc, smtpConfig, threads, ts, title, parts, errors)
+}
+
+// sendRecoveryEmail tells that the checks have recovered, in the thread of the incident
+func sendRecoveryEmail(senderFunc mailSender, smtpConfig smtpConfiguration, threads *mailThreads, ts time.Time, recovered []verificationError) error {
+	data := makeAlertTemplateData(recovered, ts)
+
+	title, err := makeMailSubject(smtpConfig.RecoverySubject, defaultRecoveryMailSubject, data)
+	if err != nil {
+		return err
+	}
+
+	body := "Recovered:\n"
+	for _, e := range recovered {
+		body += fmt.Sprintf("%s\n   %s\n", e.title, checkLabel(e))
+	}
+	if len(recovered) > 0 && recovered[0].incident.closed {
+		body += "\nAll checks are passing again.\n"
+	}
+
+	return deliverMail(senderFunc, smtpConfig, threads, ts, title, []mailPart{{"text/plain; charset=\"utf-8\"", body}}, recovered)
+}
+
+func deliverMail(senderFunc mailSender, smtpConfig smtpConfiguration, threads *mailThreads, ts time.Time, title string, parts []mailPart, errors []verificationError) error {
+	// set up possible authentication
+	auth := makeSMTPAuth(smtpConfig)
+
 	from := mail.Address{Address: smtpConfig.From}
 	toString := makeToAddresses(smtpConfig.To)
 
-	title := "Ismonitor alert"
-
-	body := makeMessage(errors)
+	messageID, thread := makeThreadIDs(ts, smtpConfig.From, errors, threads)
 
-	message := makeHeaders(from.String(), toString, title, ts) // headers
-	message += "\r\n"
-	message += base64.StdEncoding.EncodeToString([]byte(body)) // body
+	message, err := makeMail(makeHeaders(from.String(), toString, title, ts, messageID, thread), parts)
+	if err != nil {
+		return err
+	}
 
-	return senderFunc(
+	err = senderFunc(
 		smtpConfig.Host+":"+fmt.Sprintf("%d", smtpConfig.Port),
 		auth,
 		from.Address,
 		smtpConfig.To,
-		[]byte(message))
+		message)
+	if err != nil {
+		return err
+	}
+
+	// the mail is only replied to once it has been sent
+	if threads != nil && thread == "" && len(errors) > 0 && errors[0].incident.id != "" {
+		err = threads.record(messageID)
+		if err != nil {
+			log.Printf("Failed to record mail thread: %s\n", fmt.Sprint(err))
+		}
+	}
+
+	return nil
+}
+
+// makeThreadIDs returns the Message-ID of a mail about the errors and the Message-ID of the
+// first mail of their incident, which the mail is a reply to. The first mail of an incident
+// gets the Message-ID derived from the incident, so the others can refer to it. Until such a
+// mail has been sent each mail is a first mail, for none to reply to a mail that doesn't
+// exist. Without threads that is the mail of the run the incident opened with. Without an
+// incident, e.g. if the alert state couldn't be read, the mail isn't threaded.
+func makeThreadIDs(ts time.Time, from string, errors []verificationError, threads *mailThreads) (string, string) {
+	if len(errors) == 0 || errors[0].incident.id == "" {
+		return makeMessageID(ts, from), ""
+	}
+
+	incident := errors[0].incident
+	thread := fmt.Sprintf("<incident.%s.%s@%s>", incident.id, syslogHeaderField(hostname()), mailDomain(from))
+	first := incident.opened
+	if threads != nil {
+		first = !threads.started(thread)
+	}
+	if first {
+		return thread, ""
+	}
+	return makeMessageID(ts, from), thread
+}
+
+// mailThreads keeps the Message-IDs of the first mails of the incident that have been sent in
+// the alert state file
+type mailThreads struct {
+	file string
+}
+
+// started tells if the first mail of the thread has been sent. If that can't be told the mail
+// starts the thread again.
+func (t *mailThreads) started(thread string) bool {
+	state, err := loadAlertState(t.file)
+	if err != nil {
+		return false
+	}
+	for _, s := range state.Threads {
+		if s == thread {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *mailThreads) record(thread string) error {
+	unlock, err := lockFile(t.file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := loadAlertState(t.file)
+	if err != nil {
+		return err
+	}
+	for _, s := range state.Threads {
+		if s == thread {
+			return nil
+		}
+	}
+	state.Threads = append(state.Threads, thread)
+
+	return writeJSONFile(t.file, state)
+}
+
+// makeMailSubject executes the subject template, defaultText if text is empty. The subject is
+// made a single line and cut if it's too long.
+func makeMailSubject(text string, defaultText string, data alertTemplateData) (string, error) {
+	if text == "" {
+		text = defaultText
+	}
+
+	tmpl, err := parseAlertTemplate("subject", text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse subject template: %s", fmt.Sprint(err))
+	}
+	subject, err := executeAlertTemplate(tmpl, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute subject template: %s", fmt.Sprint(err))
+	}
+
+	subject = strings.Join(strings.Fields(subject), " ")
+	if r := []rune(subject); len(r) > maxMailSubjectLength {
+		subject = string(r[:maxMailSubjectLength-1]) + "…"
+	}
+
+	return subject, nil
+}
+
+// makeMailParts returns the text and html versions of the errors, or only the text executed
+// from the body template if there is one
+func makeMailParts(body string, data alertTemplateData, errors []verificationError) ([]mailPart, error) {
+	if body != "" {
+		tmpl, err := parseAlertTemplate("body", body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse body template: %s", fmt.Sprint(err))
+		}
+		text, err := executeAlertTemplate(tmpl, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute body template: %s", fmt.Sprint(err))
+		}
+		return []mailPart{{"text/plain; charset=\"utf-8\"", text}}, nil
+	}
+
+	html, err := makeHTMLMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []mailPart{
+		{"text/plain; charset=\"utf-8\"", makeMessage(errors)},
+		{"text/html; charset=\"utf-8\"", html},
+	}, nil
 }
 
 func makeToAddresses(to []string) string {
@@ -57,24 +242,100 @@ func makeToAddresses(to []string) string {
 	return toString
 }
 
-func makeHeaders(from string, to string, title string, ts time.Time) string {
+// makeHeaders returns the headers of a mail in the order they are written. The subject is
+// encoded as RFC 2047 if it isn't plain ascii. A mail in a thread is a reply to the first mail
+// of the thread.
+func makeHeaders(from string, to string, title string, ts time.Time, messageID string, thread string) []mailHeader {
 	const rfc2822 = "Mon, 02 Jan 2006 15:04:05 -0700"
 
-	header := make(map[string]string)
-	header["From"] = from
-	header["To"] = to
-	header["Subject"] = title
-	header["Date"] = ts.Format(rfc2822)
-	header["MIME-Version"] = "1.0"
-	header["Content-Type"] = "text/plain; charset=\"utf-8\""
-	header["Content-Transfer-Encoding"] = "base64"
+	headers := []mailHeader{
+		{"Date", ts.Format(rfc2822)},
+		{"From", from},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", title)},
+		{"Message-ID", messageID},
+	}
+	if thread != "" {
+		headers = append(headers, mailHeader{"In-Reply-To", thread}, mailHeader{"References", thread})
+	}
+
+	return append(headers, mailHeader{"MIME-Version", "1.0"})
+}
+
+// makeMessageID returns a unique Message-ID in the domain of the from address
+func makeMessageID(ts time.Time, from string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return fmt.Sprintf("<%d.%s@%s>", ts.UnixNano(), hex.EncodeToString(b), mailDomain(from))
+}
+
+// mailDomain returns the domain of the address, or the host name if it has none
+func mailDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 && i < len(address)-1 {
+		return address[i+1:]
+	}
+	return hostname()
+}
+
+// makeMail returns a mail with the part, or a multipart/alternative mail with the parts if
+// there are more than one
+func makeMail(headers []mailHeader, parts []mailPart) ([]byte, error) {
+	var body bytes.Buffer
+
+	if len(parts) == 1 {
+		headers = append(headers,
+			mailHeader{"Content-Type", parts[0].contentType},
+			mailHeader{"Content-Transfer-Encoding", "base64"})
+		body.WriteString(encodeBase64Lines([]byte(parts[0].content)))
+	} else {
+		w := multipart.NewWriter(&body)
+		for _, p := range parts {
+			pw, err := w.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {p.contentType},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			_, err = pw.Write([]byte(encodeBase64Lines([]byte(p.content))))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := w.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append(headers, mailHeader{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=\"%s\"", w.Boundary())})
+	}
+
+	var message bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", h.key, h.value)
+	}
+	message.WriteString("\r\n")
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
+
+// encodeBase64Lines encodes b as base64 in lines of 76 characters, the most a mail may have
+func encodeBase64Lines(b []byte) string {
+	const lineLength = 76
+
+	s := base64.StdEncoding.EncodeToString(b)
 
-	message := ""
-	for k, v := range header {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
+	var lines []string
+	for len(s) > lineLength {
+		lines = append(lines, s[:lineLength])
+		s = s[lineLength:]
 	}
+	lines = append(lines, s)
 
-	return message
+	return strings.Join(lines, "\r\n") + "\r\n"
 }
 
 func makeMessage(errors []verificationError) string {
@@ -85,3 +346,35 @@ func makeMessage(errors []verificationError) string {
 
 	return body
 }
+
+// mailHTMLTemplate is a table of the errors grouped by check with the severities in color.
+// The styles are inline as many mail clients ignore style elements.
+var mailHTMLTemplate = template.Must(template.New("mail").Funcs(template.FuncMap{
+	"color": func(severity string) template.CSS { return template.CSS(severityColors[severity]) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; font-size: 14px;">
+<p>ismonitor on {{.Hostname}} found {{len .Errors}} {{if eq (len .Errors) 1}}error{{else}}errors{{end}}.</p>
+<table style="border-collapse: collapse;" cellpadding="6">
+{{- range .Groups}}
+<tr><th colspan="2" style="text-align: left; border-bottom: 2px solid {{color .Severity}};">{{.Title}}</th></tr>
+{{- range .Errors}}
+<tr>
+<td style="vertical-align: top; color: #ffffff; background-color: {{color .Severity}};">{{.Severity}}</td>
+<td style="vertical-align: top;"><pre style="margin: 0; white-space: pre-wrap;">{{.Message}}</pre></td>
+</tr>
+{{- end}}
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+func makeHTMLMessage(data alertTemplateData) (string, error) {
+	var b bytes.Buffer
+	err := mailHTMLTemplate.Execute(&b, data)
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// The tls modes of smtpConfiguration. Opportunistic, the default, uses STARTTLS if the server
+// supports it, as smtp.SendMail does.
+const (
+	smtpTLSOpportunistic = "opportunistic"
+	smtpTLSStartTLS      = "starttls"
+	smtpTLSImplicit      = "implicit"
+	smtpTLSNone          = "none"
+)
+
+// The auth mechanisms of smtpAuth, plain unless configured
+const (
+	smtpAuthPlain   = "plain"
+	smtpAuthLogin   = "login"
+	smtpAuthCRAMMD5 = "cram-md5"
+)
+
+const defaultSMTPTimeout = 30 * time.Second
+
+func validateSMTPConfiguration(c smtpConfiguration) error {
+	if c.Host == "" || len(c.To) == 0 {
+		return fmt.Errorf("email requires host and to")
+	}
+
+	switch c.TLS {
+	case "", smtpTLSOpportunistic, smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone:
+	default:
+		return fmt.Errorf("unknown tls '%s', expected %s, %s, %s or %s", c.TLS, smtpTLSOpportunistic, smtpTLSStartTLS, smtpTLSImplicit, smtpTLSNone)
+	}
+
+	if c.Auth != nil {
+		switch c.Auth.Mechanism {
+		case "", smtpAuthPlain, smtpAuthLogin, smtpAuthCRAMMD5:
+		default:
+			return fmt.Errorf("unknown auth mechanism '%s', expected %s, %s or %s", c.Auth.Mechanism, smtpAuthPlain, smtpAuthLogin, smtpAuthCRAMMD5)
+		}
+	}
+
+	if _, err := parseAlertTemplate("subject", c.Subject); err != nil {
+		return fmt.Errorf("failed to parse subject template: %s", fmt.Sprint(err))
+	}
+	if _, err := parseAlertTemplate("body", c.Body); err != nil {
+		return fmt.Errorf("failed to parse body template: %s", fmt.Sprint(err))
+	}
+	if _, err := parseAlertTemplate("recovery_subject", c.RecoverySubject); err != nil {
+		return fmt.Errorf("failed to parse recovery subject template: %s", fmt.Sprint(err))
+	}
+	if _, err := c.timeout(); err != nil {
+		return err
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c smtpConfiguration) timeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return defaultSMTPTimeout, nil
+	}
+
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %s", fmt.Sprint(err))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return d, nil
+}
+
+// tlsConfig verifies the server against the system roots, or against the certificates in
+// ca_file if configured
+func (c smtpConfiguration) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.Host}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read ca_file: %s", fmt.Sprint(err))
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in ca_file %s", c.CAFile)
+		}
+	}
+
+	return config, nil
+}
+
+// makeSMTPAuth returns the auth of the configured mechanism, or nil without auth
+func makeSMTPAuth(c smtpConfiguration) smtp.Auth {
+	if c.Auth == nil {
+		return nil
+	}
+
+	a := *c.Auth
+	switch a.Mechanism {
+	case smtpAuthLogin:
+		return loginAuth{a.Username, a.Password, c.Host}
+	case smtpAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(a.Username, a.Password)
+	default:
+		return smtp.PlainAuth("", a.Username, a.Password, c.Host)
+	}
+}
+
+// makeMailSender returns a mailSender that connects as configured, unlike smtp.SendMail which
+// only does opportunistic STARTTLS
+func makeMailSender(c smtpConfiguration) mailSender {
+	return func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		timeout, err := c.timeout()
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		dialer := &net.Dialer{Timeout: timeout}
+		var conn net.Conn
+		if c.TLS == smtpTLSImplicit {
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		} else {
+			conn, err = dialer.Dial("tcp", addr)
+		}
+		if err != nil {
+			return err
+		}
+
+		// the timeout covers the whole conversation, not only connecting
+		err = conn.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			conn.Close()
+			return err
+		}
+
+		client, err := smtp.NewClient(conn, c.Host)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		defer client.Close()
+
+		if c.HELO != "" {
+			err = client.Hello(c.HELO)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.TLS != smtpTLSImplicit && c.TLS != smtpTLSNone {
+			ok, _ := client.Extension("STARTTLS")
+			if ok {
+				err = client.StartTLS(tlsConfig)
+				if err != nil {
+					return err
+				}
+			} else if c.TLS == smtpTLSStartTLS {
+				return fmt.Errorf("%s doesn't support STARTTLS", addr)
+			}
+		}
+
+		if a != nil {
+			if ok, _ := client.Extension("AUTH"); !ok {
+				return fmt.Errorf("%s doesn't support AUTH", addr)
+			}
+			err = client.Auth(a)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = client.Mail(from)
+		if err != nil {
+			return err
+		}
+		for _, t := range to {
+			err = client.Rcpt(t)
+			if err != nil {
+				return err
+			}
+		}
+
+		w, err := client.Data()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(msg)
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+
+		return client.Quit()
+	}
+}
+
+// loginAuth is the LOGIN mechanism, which net/smtp doesn't have. Like smtp.PlainAuth it refuses
+// to send the password unencrypted to anything but localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	local := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !local {
+		return "", nil, fmt.Errorf("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, fmt.Errorf("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge '%s'", fromServer)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSMTPServer is just enough of an SMTP server to tell how a client talked to it
+type fakeSMTPServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	implicit bool
+	starttls bool
+	password string
+	received chan fakeSMTPSession
+}
+
+type fakeSMTPSession struct {
+	helo      string
+	tls       bool
+	mechanism string
+	username  string
+	from      string
+	to        []string
+	data      string
+	err       error
+}
+
+func newFakeSMTPServer(t *testing.T, cert tls.Certificate, implicit bool, starttls bool) *fakeSMTPServer {
+	s := &fakeSMTPServer{
+		tls:      &tls.Config{Certificates: []tls.Certificate{cert}},
+		implicit: implicit,
+		starttls: starttls,
+		password: "password",
+		received: make(chan fakeSMTPSession, 1),
+	}
+
+	var err error
+	if implicit {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.received <- s.serve(conn)
+	}()
+
+	return s
+}
+
+func (s *fakeSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTPServer) close() {
+	s.listener.Close()
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) fakeSMTPSession {
+	session := fakeSMTPSession{tls: s.implicit}
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	readLine := func() string {
+		l, err := r.ReadString('\n')
+		if err != nil && session.err == nil {
+			session.err = err
+		}
+		return strings.TrimRight(l, "\r\n")
+	}
+
+	reply("220 fake ESMTP")
+	for session.err == nil {
+		line := readLine()
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+
+		switch cmd {
+		case "EHLO", "HELO":
+			session.helo = arg
+			reply("250-fake")
+			if s.starttls && !session.tls {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN LOGIN CRAM-MD5")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			err := tlsConn.Handshake()
+			if err != nil {
+				session.err = err
+				return session
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			session.tls = true
+		case "AUTH":
+			fields := strings.Fields(arg)
+			session.mechanism = fields[0]
+			ok := false
+			switch fields[0] {
+			case "PLAIN":
+				b, _ := base64.StdEncoding.DecodeString(fields[1])
+				parts := strings.Split(string(b), "\x00")
+				session.username = parts[1]
+				ok = parts[2] == s.password
+			case "LOGIN":
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				u, _ := base64.StdEncoding.DecodeString(readLine())
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				p, _ := base64.StdEncoding.DecodeString(readLine())
+				session.username = string(u)
+				ok = string(p) == s.password
+			case "CRAM-MD5":
+				challenge := "<1896.697170952@fake>"
+				reply("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+				b, _ := base64.StdEncoding.DecodeString(readLine())
+				parts := strings.Fields(string(b))
+				mac := hmac.New(md5.New, []byte(s.password))
+				mac.Write([]byte(challenge))
+				session.username = parts[0]
+				ok = parts[1] == hex.EncodeToString(mac.Sum(nil))
+			}
+			if ok {
+				reply("235 authenticated")
+			} else {
+				reply("535 authentication failed")
+			}
+		case "MAIL":
+			session.from = arg
+			reply("250 ok")
+		case "RCPT":
+			session.to = append(session.to, arg)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data []string
+			for {
+				l := readLine()
+				if l == "." || session.err != nil {
+					break
+				}
+				data = append(data, l)
+			}
+			session.data = strings.Join(data, "\n")
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return session
+		default:
+			reply("502 not implemented")
+		}
+	}
+
+	return session
+}
+
+// makeTestCertificate returns a self signed certificate for 127.0.0.1 and the file it's
+// written to as PEM
+func makeTestCertificate(t *testing.T, dir string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake smtp"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, file
+}
+
+func TestMailSender(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	cert, caFile := makeTestCertificate(t, dir)
+
+	tests := []struct {
+		name      string
+		implicit  bool
+		starttls  bool
+		tls       string
+		mechanism string
+		tlsUsed   bool
+		expected  string
+	}{
+		{"opportunistic with starttls", false, true, "", "", true, "PLAIN"},
+		{"opportunistic without starttls", false, false, "", "", false, "PLAIN"},
+		{"mandatory starttls", false, true, "starttls", "login", true, "LOGIN"},
+		{"implicit", true, false, "implicit", "cram-md5", true, "CRAM-MD5"},
+		{"none", false, true, "none", "plain", false, "PLAIN"},
+	}
+
+	for _, test := range tests {
+		server := newFakeSMTPServer(t, cert, test.implicit, test.starttls)
+
+		c := smtpConfiguration{
+			Host:    "127.0.0.1",
+			Port:    server.port(),
+			Auth:    &smtpAuth{Username: "username", Password: "password", Mechanism: test.mechanism},
+			From:    "ismonitor@example.com",
+			To:      []string{"ops@example.com", "dev@example.com"},
+			TLS:     test.tls,
+			CAFile:  caFile,
+			HELO:    "monitor.example.com",
+			Timeout: "5s",
+		}
+		assert.Nil(validateSMTPConfiguration(c), test.name)
+
+		err := sendEmail(makeMailSender(c), c, nil, time.Now(), testErrors())
+		assert.Nil(err, test.name, fmt.Sprint(err))
+
+		session := <-server.received
+		server.close()
+
+		assert.Nil(session.err, test.name)
+		assert.Equal("monitor.example.com", session.helo, test.name)
+		assert.Equal(test.tlsUsed, session.tls, test.name)
+		assert.Equal(test.expected, session.mechanism, test.name)
+		assert.Equal("username", session.username, test.name)
+		assert.Equal("FROM:<ismonitor@example.com>", session.from, test.name)
+		assert.Equal([]string{"TO:<ops@example.com>", "TO:<dev@example.com>"}, session.to, test.name)
+		assert.Contains(session.data, "Subject: =?utf-8?q?[ismonitor]", test.name)
+	}
+}
+
+func TestMailSenderFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	cert, caFile := makeTestCertificate(t, dir)
+
+	// starttls required but not offered
+	server := newFakeSMTPServer(t, cert, false, false)
+	c := smtpConfiguration{Host: "127.0.0.1", Port: server.port(), From: "from@example.com", To: []string{"to@example.com"}, TLS: "starttls", CAFile: caFile}
+	err = sendEmail(makeMailSender(c), c, nil, time.Now(), testErrors())
+	assert.NotNil(err)
+	assert.Contains(fmt.Sprint(err), "doesn't support STARTTLS")
+	server.close()
+
+	// a certificate not signed by the ca
+	server = newFakeSMTPServer(t, cert, true, false)
+	c = smtpConfiguration{Host: "127.0.0.1", Port: server.port(), From: "from@example.com", To: []string{"to@example.com"}, TLS: "implicit"}
+	err = sendEmail(makeMailSender(c), c, nil, time.Now(), testErrors())
+	assert.NotNil(err, "certificate isn't trusted")
+	server.close()
+
+	// wrong password
+	server = newFakeSMTPServer(t, cert, false, true)
+	c = smtpConfiguration{Host: "127.0.0.1", Port: server.port(), Auth: &smtpAuth{Username: "username", Password: "wrong"}, From: "from@example.com", To: []string{"to@example.com"}, CAFile: caFile}
+	err = sendEmail(makeMailSender(c), c, nil, time.Now(), testErrors())
+	assert.NotNil(err)
+	server.close()
+
+	// a server that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, fmt.Sprint(err))
+	defer ln.Close()
+	c = smtpConfiguration{Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, From: "from@example.com", To: []string{"to@example.com"}, Timeout: "200ms"}
+	start := time.Now()
+	err = sendEmail(makeMailSender(c), c, nil, time.Now(), testErrors())
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
+
+func TestValidateSMTPConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	valid := smtpConfiguration{Host: "host", Port: 25, From: "from", To: []string{"to"}}
+	assert.Nil(validateSMTPConfiguration(valid))
+
+	c := valid
+	c.To = nil
+	assert.NotNil(validateSMTPConfiguration(c), "no to")
+
+	c = valid
+	c.TLS = "ssl"
+	assert.NotNil(validateSMTPConfiguration(c), "unknown tls")
+
+	c = valid
+	c.Auth = &smtpAuth{Username: "username", Password: "password", Mechanism: "xoauth2"}
+	assert.NotNil(validateSMTPConfiguration(c), "unknown mechanism")
+
+	c = valid
+	c.Timeout = "-1s"
+	assert.NotNil(validateSMTPConfiguration(c), "negative timeout")
+
+	c = valid
+	c.CAFile = "/nonexistent/ca.pem"
+	assert.NotNil(validateSMTPConfiguration(c), "missing ca file")
+}
@@ -10,11 +10,22 @@ import (
 
 var (
 	daemonMode = flag.Bool("d", false, "run in daemon mode")
+	digestMode = flag.Bool("digest", false, "send the digest report and exit")
 )
 
 func main() {
 	flag.Parse()
 
+	if *digestMode {
+		startDigest()
+		return
+	}
+
+	if flag.NArg() > 0 {
+		startCommand(flag.Args())
+		return
+	}
+
 	context := &daemon.Context{
 		PidFileName: "pid",
 		PidFilePerm: 0644,
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// maintenanceWindow is a time when the checks it matches are expected to fail, either every
+// time CronSchedule fires and for Duration after, or from Start to End. It matches the checks
+// the same way as a silence does.
+type maintenanceWindow struct {
+	CronSchedule string    `json:"cron_schedule"`
+	Duration     string    `json:"duration"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Type         string    `json:"type"`
+	Name         string    `json:"name"`
+	Host         string    `json:"host"`
+}
+
+func validateMaintenanceWindow(w maintenanceWindow) error {
+	_, _, err := w.schedule()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range []string{w.Type, w.Name, w.Host} {
+		if !validPattern(p) {
+			return fmt.Errorf("maintenance window has an invalid pattern '%s'", p)
+		}
+	}
+
+	return nil
+}
+
+// schedule parses the cron schedule and duration of a recurring window
+func (w maintenanceWindow) schedule() (cron.Schedule, time.Duration, error) {
+	if w.CronSchedule == "" {
+		if w.Start.IsZero() || !w.End.After(w.Start) {
+			return nil, 0, fmt.Errorf("maintenance window requires a cron_schedule and duration, or a start and an end after it")
+		}
+		return nil, 0, nil
+	}
+
+	if !w.Start.IsZero() || !w.End.IsZero() {
+		return nil, 0, fmt.Errorf("maintenance window has both a cron_schedule and a start or end")
+	}
+	schedule, err := cron.Parse(w.CronSchedule)
+	if err != nil {
+		return nil, 0, fmt.Errorf("maintenance window has an invalid cron_schedule: %s", fmt.Sprint(err))
+	}
+	d, err := time.ParseDuration(w.Duration)
+	if err != nil || d <= 0 {
+		return nil, 0, fmt.Errorf("maintenance window has an invalid duration '%s'", w.Duration)
+	}
+
+	return schedule, d, nil
+}
+
+// active tells if now is within the window, i.e. the schedule fired less than the duration ago
+func (w maintenanceWindow) active(now time.Time) bool {
+	schedule, d, err := w.schedule()
+	if err != nil {
+		return false
+	}
+	if schedule == nil {
+		return !now.Before(w.Start) && now.Before(w.End)
+	}
+	return !schedule.Next(now.Add(-d)).After(now)
+}
+
+// maintenanceSilences returns the maintenance windows in effect as silences
+func maintenanceSilences(config config, now time.Time) []silence {
+	var silences []silence
+	for _, w := range config.Maintenance {
+		if w.active(now) {
+			silences = append(silences, silence{Type: w.Type, Name: w.Name, Host: w.Host})
+		}
+	}
+	return silences
+}
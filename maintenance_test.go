@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	// Sundays 02:00 to 05:00
+	w := maintenanceWindow{CronSchedule: "0 0 2 * * SUN", Duration: "3h"}
+	assert.Nil(validateMaintenanceWindow(w))
+
+	sunday := time.Date(2018, 3, 4, 0, 0, 0, 0, time.Local)
+	assert.False(w.active(sunday.Add(time.Hour + 59*time.Minute)))
+	assert.True(w.active(sunday.Add(2 * time.Hour)))
+	assert.True(w.active(sunday.Add(4*time.Hour + 59*time.Minute)))
+	assert.False(w.active(sunday.Add(5 * time.Hour)))
+	assert.False(w.active(sunday.Add(26*time.Hour)), "monday")
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	w = maintenanceWindow{Start: start, End: start.Add(time.Hour)}
+	assert.Nil(validateMaintenanceWindow(w))
+	assert.False(w.active(start.Add(-time.Second)))
+	assert.True(w.active(start))
+	assert.False(w.active(start.Add(time.Hour)))
+
+	assert.NotNil(validateMaintenanceWindow(maintenanceWindow{}))
+	assert.NotNil(validateMaintenanceWindow(maintenanceWindow{CronSchedule: "0 0 2 * * SUN"}), "no duration")
+	assert.NotNil(validateMaintenanceWindow(maintenanceWindow{CronSchedule: "sundays", Duration: "3h"}))
+	assert.NotNil(validateMaintenanceWindow(maintenanceWindow{CronSchedule: "0 0 2 * * SUN", Duration: "3h", Start: start}), "both kinds")
+	assert.NotNil(validateMaintenanceWindow(maintenanceWindow{Start: start, End: start}))
+	assert.NotNil(validateMaintenanceWindow(maintenanceWindow{Start: start, End: start.Add(time.Hour), Name: "["}))
+}
+
+func TestMaintenanceSilencesErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := config{
+		Silences: filepath.Join(dir, "silences.json"),
+		Maintenance: []maintenanceWindow{
+			{Start: start, End: start.Add(time.Hour), Type: "docker"},
+		},
+	}
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+	}
+	assert.Equal(errors[1:], silenceErrors(c, errors, start))
+	assert.Equal(errors, silenceErrors(c, errors, start.Add(time.Hour)))
+
+	c.Maintenance[0].Type = ""
+	assert.Equal(0, len(silenceErrors(c, errors, start)), "all checks")
+}
+
+func TestMaintenanceRecoveries(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := config{
+		Silences:   filepath.Join(dir, "silences.json"),
+		AlertState: filepath.Join(dir, "alert_state.json"),
+		Maintenance: []maintenanceWindow{
+			{Start: start, End: start.Add(time.Hour), Type: "docker"},
+		},
+	}
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+	}
+
+	// the disk was notified before the window, the container only failed within it
+	notified, _ := updateAlerts(c, errors[1:], start.Add(-time.Minute), nil)
+	assert.Equal(1, len(notified))
+	notified, _ = updateAlerts(c, errors, start, nil)
+	assert.Equal(1, len(notified))
+	assert.Equal("disk:/", notified[0].check)
+
+	notified, recovered := updateAlerts(c, nil, start.Add(2*time.Hour), nil)
+	assert.Equal(0, len(notified))
+	assert.Equal(1, len(recovered))
+	assert.Equal("disk:/", recovered[0].check)
+
+	// a silenced check that recovers isn't notified either
+	_, err = addSilence(c, silence{Type: "disk", Ends: start.Add(4 * time.Hour)}, start.Add(2*time.Hour))
+	assert.Nil(err, fmt.Sprint(err))
+	notified, _ = updateAlerts(c, errors[1:], start.Add(3*time.Hour), nil)
+	assert.Equal(0, len(notified))
+	_, recovered = updateAlerts(c, nil, start.Add(5*time.Hour), nil)
+	assert.Equal(0, len(recovered))
+}
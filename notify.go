@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// notifier sends the verification errors of a run somewhere
+type notifier interface {
+	notify(errors []verificationError) error
+}
+
+// recoveryNotifier is a notifier that is also told when the checks of earlier errors no
+// longer fail, e.g. to resolve an incident
+type recoveryNotifier interface {
+	notifyRecovered(recovered []verificationError) error
+}
+
+// filteringNotifier is a notifier that may hold back some of the errors, e.g. throttledNotifier,
+// and tells which it has sent
+type filteringNotifier interface {
+	notifySent(errors []verificationError) ([]verificationError, error)
+}
+
+// notifierConfiguration is an entry in the notifiers list of the configuration. Besides the
+// common fields each type has its own settings, which are given in the same object, e.g.
+// {"type": "file", "path": "alerts.txt"}.
+type notifierConfiguration struct {
+	Type string `json:"type"`
+	// Name identifies the notifier in the log, defaults to the type
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled"`
+	// QuietHours, RateLimit and MinInterval hold back some of the errors, see throttledNotifier
+	QuietHours  *quietHours `json:"quiet_hours"`
+	RateLimit   *rateLimit  `json:"rate_limit"`
+	MinInterval string      `json:"min_interval"`
+	raw         json.RawMessage
+}
+
+func (c *notifierConfiguration) UnmarshalJSON(b []byte) error {
+	// an alias type without the UnmarshalJSON method to not recurse
+	type common notifierConfiguration
+	var n common
+	err := json.Unmarshal(b, &n)
+	if err != nil {
+		return err
+	}
+
+	*c = notifierConfiguration(n)
+	c.raw = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+func (c notifierConfiguration) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c notifierConfiguration) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.Type
+}
+
+// settings unmarshals the type specific settings into v
+func (c notifierConfiguration) settings(v interface{}) error {
+	if len(c.raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.raw, v)
+}
+
+// hostname returns the name of the host ismonitor runs on, to tell where an alert comes from
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}
+
+type namedNotifier struct {
+	name string
+	notifier
+}
+
+// makeNotifiers returns the enabled notifiers. Without a notifiers list the errors are sent as
+// email if smtp is configured and otherwise written to stdout.
+func makeNotifiers(config config) ([]namedNotifier, error) {
+	if len(config.Notifiers) == 0 {
+		if len(config.Escalation) > 0 {
+			return nil, fmt.Errorf("escalation requires a list of notifiers")
+		}
+		if config.SMTP != nil {
+			err := validateSMTPConfiguration(*config.SMTP)
+			if err != nil {
+				return nil, fmt.Errorf("smtp: %s", fmt.Sprint(err))
+			}
+			return []namedNotifier{{"email", emailNotifier{*config.SMTP, makeMailSender(*config.SMTP), &mailThreads{config.alertStateFile()}}}}, nil
+		}
+		return []namedNotifier{{"stdout", writerNotifier{os.Stdout}}}, nil
+	}
+
+	escalations, err := makeEscalations(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var notifiers []namedNotifier
+	for _, c := range config.Notifiers {
+		if !c.enabled() {
+			continue
+		}
+
+		n, err := makeNotifier(c)
+		if e, ok := n.(emailNotifier); ok {
+			e.threads = &mailThreads{config.alertStateFile()}
+			n = e
+		}
+		if err == nil && c.throttled() {
+			n, err = makeThrottledNotifier(c, n, config.notifierStateFile())
+		}
+		if after, ok := escalations[c.name()]; ok && err == nil {
+			n = escalatedNotifier{n, c.name(), after, config.alertStateFile(), time.Now}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("notifier '%s': %s", c.name(), fmt.Sprint(err))
+		}
+		notifiers = append(notifiers, namedNotifier{c.name(), n})
+	}
+
+	return notifiers, nil
+}
+
+func makeNotifier(c notifierConfiguration) (notifier, error) {
+	switch c.Type {
+	case "stdout":
+		return writerNotifier{os.Stdout}, nil
+	case "email":
+		var smtpConfig smtpConfiguration
+		err := c.settings(&smtpConfig)
+		if err != nil {
+			return nil, err
+		}
+		err = validateSMTPConfiguration(smtpConfig)
+		if err != nil {
+			return nil, err
+		}
+		return emailNotifier{smtpConfig, makeMailSender(smtpConfig), nil}, nil
+	case "slack", "mattermost":
+		return makeSlackNotifier(c)
+	case "webhook":
+		return makeWebhookNotifier(c)
+	case "pagerduty":
+		return makePagerDutyNotifier(c)
+	case "alertmanager":
+		return makeAlertmanagerNotifier(c)
+	case "syslog":
+		return makeSyslogNotifier(c)
+	case "exec":
+		return makeExecNotifier(c)
+	case "jsonl":
+		var n jsonlNotifier
+		err := c.settings(&n)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case "file":
+		var n fileNotifier
+		err := c.settings(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n.Path == "" {
+			return nil, fmt.Errorf("file notifier requires path")
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("unknown type '%s'", c.Type)
+	}
+}
+
+// severityColors are the colors the severities are shown in, e.g. in slack and html mails
+var severityColors = map[string]string{
+	severityCritical: "#d00000",
+	severityWarning:  "#ffa500",
+}
+
+type errorGroup struct {
+	title    string
+	severity string
+	errors   []verificationError
+}
+
+// groupByTitle groups the errors by title in the order the titles first appear
+func groupByTitle(errors []verificationError) []errorGroup {
+	return groupErrors(errors, func(e verificationError) string { return e.title })
+}
+
+// groupByKey groups the errors by the alert they belong to, titled by the first error of each
+func groupByKey(errors []verificationError) []errorGroup {
+	return groupErrors(errors, verificationError.key)
+}
+
+func groupErrors(errors []verificationError, key func(verificationError) string) []errorGroup {
+	var groups []errorGroup
+	index := make(map[string]int)
+
+	for _, e := range errors {
+		i, ok := index[key(e)]
+		if !ok {
+			i = len(groups)
+			index[key(e)] = i
+			groups = append(groups, errorGroup{title: e.title, severity: severityWarning})
+		}
+		groups[i].errors = append(groups[i].errors, e)
+		if e.severity == severityCritical {
+			groups[i].severity = severityCritical
+		}
+	}
+
+	return groups
+}
+
+func pluralize(n int, singular string, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
+
+// truncate cuts s to at most max bytes, on a rune boundary for the result to stay valid UTF-8
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// report sends the errors, and the recovered checks to the notifiers that handle them, to all
+// notifiers at the same time. A failing notifier is logged and doesn't stop the others.
+func report(notifiers []namedNotifier, errors []verificationError, recovered []verificationError) {
+	var wg sync.WaitGroup
+
+	for _, n := range notifiers {
+		wg.Add(1)
+		go func(n namedNotifier) {
+			defer wg.Done()
+
+			if len(errors) > 0 {
+				err := n.notify(errors)
+				if err != nil {
+					log.Printf("Failed to report errors with notifier %s: %s\n", n.name, fmt.Sprint(err))
+				}
+			}
+
+			if r, ok := n.notifier.(recoveryNotifier); ok && len(recovered) > 0 {
+				err := r.notifyRecovered(recovered)
+				if err != nil {
+					log.Printf("Failed to report recoveries with notifier %s: %s\n", n.name, fmt.Sprint(err))
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+}
+
+// writerNotifier writes the errors as text, as ismonitor always has done to stdout
+type writerNotifier struct {
+	w io.Writer
+}
+
+func (n writerNotifier) notify(errors []verificationError) error {
+	for _, e := range errors {
+		_, err := fmt.Fprintf(n.w, "%s\n   %s", e.title, e.message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileNotifier appends the errors to a file, each run preceded by the time it happened
+type fileNotifier struct {
+	Path string `json:"path"`
+}
+
+func (n fileNotifier) notify(errors []verificationError) error {
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%s\n", time.Now().Format(time.RFC3339))
+	if err == nil {
+		err = writerNotifier{f}.notify(errors)
+	}
+
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+type emailNotifier struct {
+	config smtpConfiguration
+	sender mailSender
+	// threads are where the mails of the incidents are threaded, see makeThreadIDs
+	threads *mailThreads
+}
+
+func (n emailNotifier) notify(errors []verificationError) error {
+	return sendEmail(n.sender, n.config, n.threads, time.Now(), errors)
+}
+
+func (n emailNotifier) notifyRecovered(recovered []verificationError) error {
+	return sendRecoveryEmail(n.sender, n.config, n.threads, time.Now(), recovered)
+}
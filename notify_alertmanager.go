@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// alertmanagerNotifier pushes the failing checks as alerts to the v2 API of Prometheus
+// Alertmanager, which then takes care of grouping, silencing and routing them
+type alertmanagerNotifier struct {
+	// URL is the base url of alertmanager, e.g. http://localhost:9093
+	URL string `json:"url"`
+	// EndsAfter is how long an alert fires unless pushed again, e.g. 15m. It has to be longer
+	// than the time between runs for the alerts not to resolve in between.
+	EndsAfter string `json:"ends_after"`
+	// Labels are added to all alerts, e.g. {"team": "ops"}
+	Labels     map[string]string `json:"labels"`
+	MaxRetries *int              `json:"max_retries"`
+	endsAfter  time.Duration
+	retryWait  time.Duration
+}
+
+const defaultAlertmanagerEndsAfter = 15 * time.Minute
+
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+func makeAlertmanagerNotifier(c notifierConfiguration) (notifier, error) {
+	n := alertmanagerNotifier{endsAfter: defaultAlertmanagerEndsAfter, retryWait: time.Second}
+	err := c.settings(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n.URL == "" {
+		return nil, fmt.Errorf("alertmanager notifier requires url")
+	}
+	if n.EndsAfter != "" {
+		n.endsAfter, err = time.ParseDuration(n.EndsAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ends_after: %s", fmt.Sprint(err))
+		}
+		if n.endsAfter <= 0 {
+			return nil, fmt.Errorf("ends_after must be positive")
+		}
+	}
+	if n.MaxRetries == nil {
+		retries := defaultMaxRetries
+		n.MaxRetries = &retries
+	}
+
+	return n, nil
+}
+
+// notify fires an alert for each check, ending after the configured time unless the check
+// fails again
+func (n alertmanagerNotifier) notify(errors []verificationError) error {
+	endsAt := time.Now().Add(n.endsAfter).UTC()
+
+	var alerts []alertmanagerAlert
+	for _, g := range groupByKey(errors) {
+		var messages []string
+		for _, e := range g.errors {
+			messages = append(messages, strings.TrimRight(e.message, "\n"))
+		}
+
+		alerts = append(alerts, alertmanagerAlert{
+			Labels: n.labels(g.errors[0].key(), g.title, g.severity),
+			Annotations: map[string]string{
+				"summary":     strings.SplitN(messages[0], "\n", 2)[0],
+				"description": strings.Join(messages, "\n"),
+			},
+			EndsAt: endsAt,
+		})
+	}
+
+	return n.send(alerts)
+}
+
+// notifyRecovered resolves the alerts of the recovered checks by ending them now. The labels
+// have to be the same as when the alert fired for alertmanager to know which alert it is.
+func (n alertmanagerNotifier) notifyRecovered(recovered []verificationError) error {
+	now := time.Now().UTC()
+
+	var alerts []alertmanagerAlert
+	for _, e := range recovered {
+		alerts = append(alerts, alertmanagerAlert{
+			Labels: n.labels(e.key(), e.title, e.severity),
+			EndsAt: now,
+		})
+	}
+
+	return n.send(alerts)
+}
+
+// labels returns the labels of the alert of a check. Docker and disk usage checks are labeled
+// with the container and mount they check.
+func (n alertmanagerNotifier) labels(check string, title string, severity string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range n.Labels {
+		labels[k] = v
+	}
+
+	labels["alertname"] = title
+	labels["check"] = check
+	labels["host"] = hostname()
+	labels["severity"] = severity
+	if strings.HasPrefix(check, "docker:") {
+		labels["container"] = strings.TrimPrefix(check, "docker:")
+	}
+	if strings.HasPrefix(check, "disk:") {
+		labels["mount"] = strings.TrimPrefix(check, "disk:")
+	}
+
+	return labels
+}
+
+func (n alertmanagerNotifier) send(alerts []alertmanagerAlert) error {
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	return sendWithRetry("POST", strings.TrimRight(n.URL, "/")+"/api/v2/alerts", headers, b, *n.MaxRetries, n.retryWait)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newAlertmanagerServer(t *testing.T, posts *[][]alertmanagerAlert) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var alerts []alertmanagerAlert
+		err := json.NewDecoder(r.Body).Decode(&alerts)
+		if err != nil {
+			// t.Fatal can't be called from the handler goroutine
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*posts = append(*posts, alerts)
+	}))
+}
+
+func TestAlertmanagerNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var posts [][]alertmanagerAlert
+	server := newAlertmanagerServer(t, &posts)
+	defer server.Close()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "alertmanager", "url": "%s/", "ends_after": "10m", "labels": {"team": "ops"}}`, server.URL))
+
+	before := time.Now()
+	assert.Nil(n.notify(pagerDutyTestErrors()))
+
+	assert.Equal(1, len(posts))
+	alerts := posts[0]
+	assert.Equal(3, len(alerts), "one alert per check")
+
+	assert.Equal(map[string]string{
+		"alertname": "Disk usage verification error",
+		"check":     "disk:/",
+		"host":      hostname(),
+		"severity":  severityWarning,
+		"mount":     "/",
+		"team":      "ops",
+	}, alerts[0].Labels)
+	assert.Equal("Disk usage of / at 92 percent", alerts[0].Annotations["summary"])
+	assert.True(alerts[0].EndsAt.After(before.Add(9*time.Minute)), fmt.Sprint(alerts[0].EndsAt))
+	assert.True(alerts[0].EndsAt.Before(before.Add(11*time.Minute)), fmt.Sprint(alerts[0].EndsAt))
+
+	assert.Equal("nginx", alerts[1].Labels["container"])
+	assert.Equal(severityCritical, alerts[1].Labels["severity"])
+
+	assert.Equal("elk:errors", alerts[2].Labels["check"])
+	assert.Equal("Expected 0 matches, got 2", alerts[2].Annotations["summary"])
+	assert.Equal("Expected 0 matches, got 2\n   line 1\n   line 2\nFailed to parse hit template", alerts[2].Annotations["description"])
+
+	recovered := []verificationError{{title: "Docker verification error", severity: severityCritical, check: "docker:nginx"}}
+	assert.Nil(n.(recoveryNotifier).notifyRecovered(recovered))
+
+	assert.Equal(2, len(posts))
+	assert.Equal(1, len(posts[1]))
+	assert.Equal(alerts[1].Labels, posts[1][0].Labels, "resolved with the labels it fired with")
+	assert.False(posts[1][0].EndsAt.After(time.Now()))
+}
+
+func TestMakeAlertmanagerNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "alertmanager"}]}`), &c))
+	_, err := makeNotifiers(c)
+	assert.NotNil(err, "no url")
+
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "alertmanager", "url": "http://localhost:9093", "ends_after": "15 minutes"}]}`), &c))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "invalid ends_after")
+
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "alertmanager", "url": "http://localhost:9093"}]}`), &c))
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(defaultAlertmanagerEndsAfter, notifiers[0].notifier.(alertmanagerNotifier).endsAfter)
+}
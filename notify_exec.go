@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// execNotifier runs a command for each batch of errors, e.g. a script sending an SMS. The errors
+// are given as json on stdin, the same as the default body of the webhook notifier, and the
+// most important facts as environment variables.
+type execNotifier struct {
+	// Command is the program and its arguments, it isn't run through a shell
+	Command []string `json:"command"`
+	Timeout string   `json:"timeout"`
+	timeout time.Duration
+}
+
+const defaultExecTimeout = 30 * time.Second
+
+func makeExecNotifier(c notifierConfiguration) (notifier, error) {
+	n := execNotifier{timeout: defaultExecTimeout}
+	err := c.settings(&n)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.Command) == 0 || n.Command[0] == "" {
+		return nil, fmt.Errorf("exec notifier requires command")
+	}
+	if n.Timeout != "" {
+		n.timeout, err = time.ParseDuration(n.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %s", fmt.Sprint(err))
+		}
+		if n.timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be positive")
+		}
+	}
+
+	return n, nil
+}
+
+func (n execNotifier) notify(errors []verificationError) error {
+	return n.run("alert", errors)
+}
+
+// notifyRecovered runs the command for the recovered checks as well, with ISMONITOR_EVENT set
+// to recovery
+func (n execNotifier) notifyRecovered(recovered []verificationError) error {
+	return n.run("recovery", recovered)
+}
+
+func (n execNotifier) run(event string, errors []verificationError) error {
+	stdin, err := json.Marshal(makeAlertTemplateData(errors, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(n.Command[0], n.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), execEnvironment(event, errors)...)
+	// the command runs in a process group of its own to kill what it started too when it times
+	// out, which may otherwise hold stderr open and keep it from being waited for
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", n.Command[0], fmt.Sprint(err))
+	}
+
+	var timedOut int32
+	timer := time.AfterFunc(n.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+
+	s := bufio.NewScanner(&stderr)
+	for s.Scan() {
+		log.Printf("%s: %s\n", n.Command[0], s.Text())
+	}
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("%s timed out after %s", n.Command[0], n.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", n.Command[0], fmt.Sprint(err))
+	}
+	return nil
+}
+
+// execEnvironment returns the environment variables describing the errors, for scripts that
+// don't want to parse the json
+func execEnvironment(event string, errors []verificationError) []string {
+	critical := 0
+	var titles []string
+	for _, g := range groupByTitle(errors) {
+		titles = append(titles, g.title)
+	}
+	for _, e := range errors {
+		if e.severity == severityCritical {
+			critical++
+		}
+	}
+
+	severity := severityWarning
+	if critical > 0 {
+		severity = severityCritical
+	}
+
+	return []string{
+		"ISMONITOR_EVENT=" + event,
+		"ISMONITOR_HOSTNAME=" + hostname(),
+		"ISMONITOR_ERRORS=" + strconv.Itoa(len(errors)),
+		"ISMONITOR_CRITICAL=" + strconv.Itoa(critical),
+		"ISMONITOR_WARNING=" + strconv.Itoa(len(errors)-critical),
+		"ISMONITOR_SEVERITY=" + severity,
+		"ISMONITOR_TITLES=" + strings.Join(titles, ", "),
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	stdin := filepath.Join(dir, "stdin.json")
+	env := filepath.Join(dir, "env")
+	script := `cat > "$1"; env | grep ^ISMONITOR_ | sort > "$2"; echo "modem not found" >&2`
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "exec", "command": ["sh", "-c", %q, "sh", %q, %q]}`, script, stdin, env))
+	assert.Nil(n.notify(testErrors()))
+
+	b, err := ioutil.ReadFile(stdin)
+	assert.Nil(err, fmt.Sprint(err))
+	var data alertTemplateData
+	assert.Nil(json.Unmarshal(b, &data), string(b))
+	assert.Equal(3, len(data.Errors))
+	assert.Equal("Docker container 'nginx' is not running", data.Errors[1].Message)
+
+	b, err = ioutil.ReadFile(env)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal([]string{
+		"ISMONITOR_CRITICAL=1",
+		"ISMONITOR_ERRORS=3",
+		"ISMONITOR_EVENT=alert",
+		"ISMONITOR_HOSTNAME=" + hostname(),
+		"ISMONITOR_SEVERITY=critical",
+		"ISMONITOR_TITLES=Disk usage verification error, Docker verification error",
+		"ISMONITOR_WARNING=2",
+	}, strings.Split(strings.TrimSpace(string(b)), "\n"))
+
+	assert.Contains(logs.String(), "sh: modem not found")
+
+	assert.Nil(n.(recoveryNotifier).notifyRecovered(testErrors()[:1]))
+	b, err = ioutil.ReadFile(env)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Contains(string(b), "ISMONITOR_EVENT=recovery\n")
+	assert.Contains(string(b), "ISMONITOR_SEVERITY=warning\n")
+}
+
+func TestExecNotifierFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	n := makeTestNotifier(t, `{"type": "exec", "command": ["sh", "-c", "exit 3"]}`)
+	err := n.notify(testErrors())
+	assert.NotNil(err)
+	assert.Contains(fmt.Sprint(err), "exit status 3")
+
+	n = makeTestNotifier(t, `{"type": "exec", "command": ["sleep", "5"], "timeout": "100ms"}`)
+	err = n.notify(testErrors())
+	assert.NotNil(err)
+	assert.Contains(fmt.Sprint(err), "timed out")
+
+	// a child left behind holding stderr doesn't hold up the notifier
+	n = makeTestNotifier(t, `{"type": "exec", "command": ["sh", "-c", "sleep 5 & sleep 5"], "timeout": "500ms"}`)
+	start := time.Now()
+	err = n.notify(testErrors())
+	assert.NotNil(err)
+	assert.Contains(fmt.Sprint(err), "timed out")
+	assert.True(time.Since(start) < 3*time.Second, time.Since(start))
+}
+
+func TestMakeExecNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []string{
+		`{"type": "exec"}`,
+		`{"type": "exec", "command": [""]}`,
+		`{"type": "exec", "command": ["page.sh"], "timeout": "soon"}`,
+	} {
+		var conf config
+		assert.Nil(json.Unmarshal([]byte(`{"notifiers": [`+c+`]}`), &conf))
+		_, err := makeNotifiers(conf)
+		assert.NotNil(err, c)
+	}
+
+	n := makeTestNotifier(t, `{"type": "exec", "command": ["page.sh", "--urgent"]}`).(execNotifier)
+	assert.Equal(defaultExecTimeout, n.timeout)
+}
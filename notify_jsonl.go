@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+// jsonlNotifier writes each error as a line of json, to a file or to stdout if no path is
+// configured
+type jsonlNotifier struct {
+	Path string `json:"path"`
+}
+
+// jsonlRecord is a line written by the jsonl notifier
+type jsonlRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	alertData
+}
+
+func (n jsonlNotifier) notify(errors []verificationError) error {
+	if n.Path == "" {
+		return writeJSONLines(os.Stdout, time.Now(), errors)
+	}
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+
+	err = writeJSONLines(f, time.Now(), errors)
+
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+func writeJSONLines(w io.Writer, ts time.Time, errors []verificationError) error {
+	enc := json.NewEncoder(w)
+	for _, e := range errors {
+		err := enc.Encode(jsonlRecord{Timestamp: ts, Hostname: hostname(), alertData: makeAlertData(e)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONLinesNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "alerts.jsonl")
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "jsonl", "path": "%s"}`, path))
+	assert.Nil(n.notify(testErrors()))
+	assert.Nil(n.notify([]verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}))
+
+	f, err := os.Open(path)
+	assert.Nil(err, fmt.Sprint(err))
+	defer f.Close()
+
+	var records []map[string]interface{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r map[string]interface{}
+		assert.Nil(json.Unmarshal(s.Bytes(), &r), s.Text())
+		records = append(records, r)
+	}
+
+	assert.Equal(4, len(records))
+	assert.Equal("Disk usage verification error", records[0]["title"])
+	assert.Equal("Disk usage of / at 92 percent", records[0]["message"])
+	assert.Equal(severityWarning, records[0]["severity"])
+	assert.Equal(hostname(), records[0]["hostname"])
+	assert.NotNil(records[0]["timestamp"])
+	assert.Equal("docker:nginx", records[3]["check"])
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// pagerDutyNotifier triggers a PagerDuty incident for each failing check through the Events
+// API v2 and resolves it when the check recovers. The dedup key of a check is the same from run
+// to run, so a check failing again while its incident is open doesn't page anew.
+type pagerDutyNotifier struct {
+	// URL is the events endpoint, it only needs to be set to send the events elsewhere
+	URL        string `json:"url"`
+	RoutingKey string `json:"routing_key"`
+	// Severity is the least severe error that pages, critical unless configured
+	Severity   string `json:"severity"`
+	MaxRetries *int   `json:"max_retries"`
+	retryWait  time.Duration
+}
+
+const defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutySummaryLimit is the maximum length of the summary of an event, longer ones are cut
+const pagerDutySummaryLimit = 1024
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Client      string            `json:"client,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Component     string                 `json:"component,omitempty"`
+	Group         string                 `json:"group,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+func makePagerDutyNotifier(c notifierConfiguration) (notifier, error) {
+	n := pagerDutyNotifier{URL: defaultPagerDutyURL, Severity: severityCritical, retryWait: time.Second}
+	err := c.settings(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n.RoutingKey == "" {
+		return nil, fmt.Errorf("pagerduty notifier requires routing_key")
+	}
+	if n.Severity != severityWarning && n.Severity != severityCritical {
+		return nil, fmt.Errorf("unknown severity '%s', expected %s or %s", n.Severity, severityWarning, severityCritical)
+	}
+	if n.MaxRetries == nil {
+		retries := defaultMaxRetries
+		n.MaxRetries = &retries
+	}
+
+	return n, nil
+}
+
+// pages tells if errors of the severity trigger incidents
+func (n pagerDutyNotifier) pages(severity string) bool {
+	return severity == severityCritical || n.Severity == severityWarning
+}
+
+func pagerDutyDedupKey(check string) string {
+	return fmt.Sprintf("ismonitor/%s/%s", hostname(), check)
+}
+
+// notify triggers an event for each check, with all the errors of the check as details
+func (n pagerDutyNotifier) notify(errors []verificationError) error {
+	var events []pagerDutyEvent
+	for _, g := range groupByKey(errors) {
+		if n.pages(g.severity) {
+			events = append(events, makePagerDutyTrigger(n.RoutingKey, g))
+		}
+	}
+
+	return n.send(events)
+}
+
+func (n pagerDutyNotifier) notifyRecovered(recovered []verificationError) error {
+	var events []pagerDutyEvent
+	for _, e := range recovered {
+		if !n.pages(e.severity) {
+			continue
+		}
+		events = append(events, pagerDutyEvent{
+			RoutingKey:  n.RoutingKey,
+			EventAction: "resolve",
+			DedupKey:    pagerDutyDedupKey(e.key()),
+		})
+	}
+
+	return n.send(events)
+}
+
+func makePagerDutyTrigger(routingKey string, g errorGroup) pagerDutyEvent {
+	var messages []string
+	for _, e := range g.errors {
+		messages = append(messages, strings.TrimRight(e.message, "\n"))
+	}
+
+	// the first line of the first error is usually enough to tell what's wrong
+	summary := fmt.Sprintf("%s on %s: %s", g.title, hostname(), strings.SplitN(messages[0], "\n", 2)[0])
+	if len(summary) > pagerDutySummaryLimit {
+		summary = truncate(summary, pagerDutySummaryLimit-len("…")) + "…"
+	}
+
+	return pagerDutyEvent{
+		RoutingKey:  routingKey,
+		EventAction: "trigger",
+		DedupKey:    pagerDutyDedupKey(g.errors[0].key()),
+		Client:      "ismonitor",
+		Payload: &pagerDutyPayload{
+			Summary:   summary,
+			Source:    hostname(),
+			Severity:  g.severity,
+			Component: g.errors[0].key(),
+			Group:     g.title,
+			CustomDetails: map[string]interface{}{
+				"errors": messages,
+			},
+		},
+	}
+}
+
+// send sends the events one at a time, carrying on with the rest if one fails
+func (n pagerDutyNotifier) send(events []pagerDutyEvent) error {
+	var failures []string
+
+	for _, e := range events {
+		b, err := json.Marshal(e)
+		if err == nil {
+			headers := map[string]string{"Content-Type": "application/json"}
+			err = sendWithRetry("POST", n.URL, headers, b, *n.MaxRetries, n.retryWait)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s of %s: %s", e.EventAction, e.DedupKey, fmt.Sprint(err)))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to send %d of %d events: %s", len(failures), len(events), strings.Join(failures, ", "))
+	}
+	return nil
+}
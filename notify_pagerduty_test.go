@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPagerDutyServer(t *testing.T, events *[]pagerDutyEvent) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e pagerDutyEvent
+		err := json.NewDecoder(r.Body).Decode(&e)
+		if err != nil {
+			// t.Fatal can't be called from the handler goroutine
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*events = append(*events, e)
+
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"status": "success", "message": "Event processed", "dedup_key": "`+e.DedupKey+`"}`)
+	}))
+}
+
+func pagerDutyTestErrors() []verificationError {
+	return []verificationError{
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Elk verification error", message: "Expected 0 matches, got 2\n   line 1\n   line 2\n", severity: severityCritical, check: "elk:errors"},
+		{title: "Elk verification error", message: "Failed to parse hit template\n", severity: severityCritical, check: "elk:errors"},
+	}
+}
+
+func TestPagerDutyNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var events []pagerDutyEvent
+	server := newPagerDutyServer(t, &events)
+	defer server.Close()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "pagerduty", "url": "%s", "routing_key": "R0UT1NGK3Y"}`, server.URL))
+	assert.Nil(n.notify(pagerDutyTestErrors()))
+
+	// the warning doesn't page and the errors of a check are one event
+	assert.Equal(2, len(events))
+	assert.Equal("trigger", events[0].EventAction)
+	assert.Equal("R0UT1NGK3Y", events[0].RoutingKey)
+	assert.Equal("ismonitor/"+hostname()+"/docker:nginx", events[0].DedupKey)
+	assert.Equal("Docker verification error on "+hostname()+": Docker container 'nginx' is not running", events[0].Payload.Summary)
+	assert.Equal(severityCritical, events[0].Payload.Severity)
+	assert.Equal(hostname(), events[0].Payload.Source)
+	assert.Equal("ismonitor/"+hostname()+"/elk:errors", events[1].DedupKey)
+	assert.Equal("Elk verification error on "+hostname()+": Expected 0 matches, got 2", events[1].Payload.Summary)
+	assert.Equal([]interface{}{"Expected 0 matches, got 2\n   line 1\n   line 2", "Failed to parse hit template"}, events[1].Payload.CustomDetails["errors"])
+
+	// failing again gives the same dedup key
+	assert.Nil(n.notify(pagerDutyTestErrors()))
+	assert.Equal(4, len(events))
+	assert.Equal(events[0].DedupKey, events[2].DedupKey)
+
+	recovered := []verificationError{
+		{title: "Disk usage verification error", severity: severityWarning, check: "disk:/"},
+		{title: "Docker verification error", severity: severityCritical, check: "docker:nginx"},
+	}
+	assert.Nil(n.(recoveryNotifier).notifyRecovered(recovered))
+	assert.Equal(5, len(events))
+	assert.Equal("resolve", events[4].EventAction)
+	assert.Equal(events[0].DedupKey, events[4].DedupKey)
+	assert.Nil(events[4].Payload)
+
+	// with warnings paging as well
+	events = nil
+	n = makeTestNotifier(t, fmt.Sprintf(`{"type": "pagerduty", "url": "%s", "routing_key": "R0UT1NGK3Y", "severity": "warning"}`, server.URL))
+	assert.Nil(n.notify(pagerDutyTestErrors()))
+	assert.Equal(3, len(events))
+	assert.Equal("ismonitor/"+hostname()+"/disk:/", events[0].DedupKey)
+	assert.Equal(severityWarning, events[0].Payload.Severity)
+}
+
+func TestPagerDutyNotifierFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status": "invalid event", "message": "Event object is invalid"}`)
+	}))
+	defer server.Close()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "pagerduty", "url": "%s", "routing_key": "R0UT1NGK3Y"}`, server.URL))
+	err := n.notify(pagerDutyTestErrors())
+	assert.NotNil(err)
+	assert.Contains(fmt.Sprint(err), "failed to send 2 of 2 events")
+}
+
+func TestMakePagerDutyNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "pagerduty"}]}`), &c))
+	_, err := makeNotifiers(c)
+	assert.NotNil(err, "no routing key")
+
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "pagerduty", "routing_key": "R0UT1NGK3Y", "severity": "info"}]}`), &c))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "unknown severity")
+
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "pagerduty", "routing_key": "R0UT1NGK3Y"}]}`), &c))
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(defaultPagerDutyURL, notifiers[0].notifier.(pagerDutyNotifier).URL)
+}
+
+func TestPagerDutySummaryLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	errors := []verificationError{{title: "Log file verification error", message: strings.Repeat("å", 1000) + "\n", severity: severityCritical, check: "log_file:app"}}
+	e := makePagerDutyTrigger("key", groupByKey(errors)[0])
+	assert.True(len(e.Payload.Summary) <= pagerDutySummaryLimit, len(e.Payload.Summary))
+	assert.True(utf8.ValidString(e.Payload.Summary))
+	assert.True(strings.HasSuffix(e.Payload.Summary, "å…"))
+}
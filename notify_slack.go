@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	slackFormatAttachments = "attachments"
+	slackFormatBlocks      = "blocks"
+)
+
+// slackNotifier posts the errors to a Slack or Mattermost incoming webhook
+type slackNotifier struct {
+	URL       string `json:"url"`
+	Channel   string `json:"channel"`
+	Username  string `json:"username"`
+	IconEmoji string `json:"icon_emoji"`
+	// Format is either attachments, which Mattermost understands as well, or blocks
+	Format     string `json:"format"`
+	MaxRetries *int   `json:"max_retries"`
+	// retryWait is the wait before the first retry unless the response says otherwise. It's
+	// doubled for each retry.
+	retryWait time.Duration
+}
+
+// slackTextLimit is the maximum length of a text field in a block, longer texts are cut
+const slackTextLimit = 3000
+
+// slackBlockLimit is the maximum number of blocks of a message, the groups that don't fit are
+// merged into the last block
+const slackBlockLimit = 50
+
+var slackEmojis = map[string]string{
+	severityCritical: ":red_circle:",
+	severityWarning:  ":large_orange_circle:",
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	IconEmoji   string            `json:"icon_emoji,omitempty"`
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+	Blocks      []slackBlock      `json:"blocks,omitempty"`
+}
+
+type slackAttachment struct {
+	Fallback string `json:"fallback"`
+	Color    string `json:"color"`
+	Title    string `json:"title"`
+	Text     string `json:"text"`
+}
+
+type slackBlock struct {
+	Type string     `json:"type"`
+	Text *slackText `json:"text,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func makeSlackNotifier(c notifierConfiguration) (notifier, error) {
+	n := slackNotifier{retryWait: time.Second}
+	err := c.settings(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n.URL == "" {
+		return nil, fmt.Errorf("%s notifier requires url", c.Type)
+	}
+	switch n.Format {
+	case "":
+		n.Format = slackFormatAttachments
+	case slackFormatAttachments, slackFormatBlocks:
+	default:
+		return nil, fmt.Errorf("unknown format '%s', expected %s or %s", n.Format, slackFormatAttachments, slackFormatBlocks)
+	}
+	if n.MaxRetries == nil {
+		retries := defaultMaxRetries
+		n.MaxRetries = &retries
+	}
+
+	return n, nil
+}
+
+func (n slackNotifier) notify(errors []verificationError) error {
+	b, err := json.Marshal(makeSlackMessage(n, errors))
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	return sendWithRetry("POST", n.URL, headers, b, *n.MaxRetries, n.retryWait)
+}
+
+// makeSlackMessage groups the errors by title with the most severe severity of the group
+// deciding the color
+func makeSlackMessage(n slackNotifier, errors []verificationError) slackMessage {
+	m := slackMessage{
+		Channel:   n.Channel,
+		Username:  n.Username,
+		IconEmoji: n.IconEmoji,
+		Text:      fmt.Sprintf("ismonitor on %s: %d %s", hostname(), len(errors), pluralize(len(errors), "error", "errors")),
+	}
+
+	groups := groupByTitle(errors)
+	var rest []string
+	for i, g := range groups {
+		var text []string
+		for _, e := range g.errors {
+			text = append(text, strings.TrimRight(e.message, "\n"))
+		}
+
+		switch {
+		case n.Format == slackFormatBlocks && len(groups) > slackBlockLimit && i >= slackBlockLimit-1:
+			rest = append(rest, fmt.Sprintf("%s *%s*: %s", slackEmojis[g.severity], g.title, strings.Join(text, ", ")))
+		case n.Format == slackFormatBlocks:
+			body := fmt.Sprintf("%s *%s*\n```%s```", slackEmojis[g.severity], g.title, strings.Join(text, "\n"))
+			if len(body) > slackTextLimit {
+				body = truncate(body, slackTextLimit-len("…```")) + "…```"
+			}
+			m.Blocks = append(m.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: body}})
+		default:
+			m.Attachments = append(m.Attachments, slackAttachment{
+				Fallback: fmt.Sprintf("%s: %s", g.title, strings.Join(text, ", ")),
+				Color:    severityColors[g.severity],
+				Title:    g.title,
+				Text:     strings.Join(text, "\n"),
+			})
+		}
+	}
+
+	if len(rest) > 0 {
+		body := strings.Join(rest, "\n")
+		if len(body) > slackTextLimit {
+			body = truncate(body, slackTextLimit-len("…")) + "…"
+		}
+		m.Blocks = append(m.Blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: body}})
+	}
+
+	return m
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testErrors() []verificationError {
+	return []verificationError{
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning},
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical},
+		{title: "Disk usage verification error", message: "Disk usage of /boot at 85 percent\n", severity: severityWarning},
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var messages []slackMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+
+		b, err := ioutil.ReadAll(r.Body)
+		assert.Nil(err, fmt.Sprint(err))
+		var m slackMessage
+		assert.Nil(json.Unmarshal(b, &m))
+		messages = append(messages, m)
+
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	var c config
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"notifiers": [{"type": "slack", "url": "%s", "channel": "#ops"}]}`, server.URL)), &c)
+	assert.Nil(err, fmt.Sprint(err))
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+
+	err = notifiers[0].notify(testErrors())
+	assert.Nil(err, fmt.Sprint(err))
+
+	assert.Equal(1, len(messages))
+	m := messages[0]
+	assert.Equal("#ops", m.Channel)
+	assert.Equal(fmt.Sprintf("ismonitor on %s: 3 errors", hostname()), m.Text)
+	assert.Equal(2, len(m.Attachments))
+	assert.Equal("Disk usage verification error", m.Attachments[0].Title)
+	assert.Equal("#ffa500", m.Attachments[0].Color)
+	assert.Equal("Disk usage of / at 92 percent\nDisk usage of /boot at 85 percent", m.Attachments[0].Text)
+	assert.Equal("Docker verification error", m.Attachments[1].Title)
+	assert.Equal("#d00000", m.Attachments[1].Color)
+	assert.Equal(0, len(m.Blocks))
+}
+
+func TestSlackNotifierBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	n := slackNotifier{Format: slackFormatBlocks}
+	m := makeSlackMessage(n, testErrors())
+
+	assert.Equal(0, len(m.Attachments))
+	assert.Equal(2, len(m.Blocks))
+	assert.Equal("section", m.Blocks[0].Type)
+	assert.Equal("mrkdwn", m.Blocks[0].Text.Type)
+	assert.Equal(":large_orange_circle: *Disk usage verification error*\n```Disk usage of / at 92 percent\nDisk usage of /boot at 85 percent```", m.Blocks[0].Text.Text)
+	assert.Equal(":red_circle: *Docker verification error*\n```Docker container 'nginx' is not running```", m.Blocks[1].Text.Text)
+
+	long := []verificationError{{title: "Title", message: strings.Repeat("x", 5000)}}
+	m = makeSlackMessage(n, long)
+	assert.Equal(slackTextLimit, len(m.Blocks[0].Text.Text))
+
+	// multi-byte characters aren't split
+	long = []verificationError{{title: "Title", message: strings.Repeat("å", 5000)}}
+	m = makeSlackMessage(n, long)
+	assert.True(len(m.Blocks[0].Text.Text) <= slackTextLimit)
+	assert.True(utf8.ValidString(m.Blocks[0].Text.Text))
+	assert.True(strings.HasSuffix(m.Blocks[0].Text.Text, "å…```"))
+
+	// the groups that don't fit in the blocks of a message are merged into the last
+	var many []verificationError
+	for i := 0; i < 60; i++ {
+		many = append(many, verificationError{title: fmt.Sprintf("Title %d", i), message: "failed\n", severity: severityWarning})
+	}
+	m = makeSlackMessage(n, many)
+	assert.Equal(slackBlockLimit, len(m.Blocks))
+	assert.Equal(":large_orange_circle: *Title 48*\n```failed```", m.Blocks[48].Text.Text)
+	assert.True(strings.HasPrefix(m.Blocks[49].Text.Text, ":large_orange_circle: *Title 49*: failed\n:large_orange_circle: *Title 50*: failed\n"))
+	assert.True(strings.HasSuffix(m.Blocks[49].Text.Text, "*Title 59*: failed"))
+
+	m = makeSlackMessage(n, many[:slackBlockLimit])
+	assert.Equal(slackBlockLimit, len(m.Blocks))
+	assert.Equal(":large_orange_circle: *Title 49*\n```failed```", m.Blocks[49].Text.Text)
+}
+
+func TestSlackNotifierRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "rate_limited", http.StatusTooManyRequests)
+		case 2:
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, "ok")
+		}
+	}))
+	defer server.Close()
+
+	retries := 3
+	n := slackNotifier{URL: server.URL, MaxRetries: &retries}
+	err := n.notify(testErrors())
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(3, requests)
+
+	// give up after the retries
+	requests = 0
+	retries = 1
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	err = n.notify(testErrors())
+	assert.NotNil(err)
+	assert.Equal(2, requests)
+
+	// client errors aren't retried
+	requests = 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+	})
+	err = n.notify(testErrors())
+	assert.Equal("webhook responded with status 400: invalid_payload", fmt.Sprint(err))
+	assert.Equal(1, requests)
+}
+
+func TestSendWithRetryLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(time.Duration(0), retryAfter(-1))
+	assert.Equal(5*time.Second, retryAfter(5))
+	assert.Equal(maxRetryWait, retryAfter(86400))
+	assert.Equal(maxRetryWait, retryAfter(1<<62))
+
+	// a hung endpoint times out
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	timeout := notifierClient.Timeout
+	notifierClient.Timeout = 100 * time.Millisecond
+	defer func() { notifierClient.Timeout = timeout }()
+
+	start := time.Now()
+	err := sendWithRetry("POST", server.URL, nil, []byte("{}"), 0, time.Millisecond)
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 5*time.Second, time.Since(start))
+}
+
+func TestMakeSlackNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	err := json.Unmarshal([]byte(`{"notifiers": [{"type": "mattermost"}]}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "no url")
+
+	err = json.Unmarshal([]byte(`{"notifiers": [{"type": "slack", "url": "http://localhost", "format": "markdown"}]}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "unknown format")
+}
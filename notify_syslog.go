@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// syslogNotifier sends each error as an RFC 5424 syslog message, to the local syslog daemon by
+// default
+type syslogNotifier struct {
+	// Network is unixgram, unix, udp or tcp
+	Network string `json:"network"`
+	// Address is the path of the socket or host:port
+	Address  string `json:"address"`
+	Facility string `json:"facility"`
+	AppName  string `json:"app_name"`
+	facility int
+}
+
+const defaultSyslogAddress = "/dev/log"
+
+// syslogTimeout is how long connecting and sending may take
+const syslogTimeout = 10 * time.Second
+
+// syslogSDID is the id of the structured data element with the error's fields. 32473 is the
+// enterprise number reserved for examples, there being no registered one for ismonitor.
+const syslogSDID = "ismonitor@32473"
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities maps the severity of an error to the syslog one, crit and warning
+var syslogSeverities = map[string]int{
+	severityCritical: 2,
+	severityWarning:  4,
+}
+
+func makeSyslogNotifier(c notifierConfiguration) (notifier, error) {
+	n := syslogNotifier{Network: "unixgram", Facility: "daemon", AppName: "ismonitor"}
+	err := c.settings(&n)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.Network {
+	case "unixgram", "unix":
+		if n.Address == "" {
+			n.Address = defaultSyslogAddress
+		}
+	case "udp", "tcp":
+		if n.Address == "" {
+			return nil, fmt.Errorf("syslog notifier over %s requires address", n.Network)
+		}
+	default:
+		return nil, fmt.Errorf("unknown network '%s', expected unixgram, unix, udp or tcp", n.Network)
+	}
+
+	facility, ok := syslogFacilities[n.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility '%s'", n.Facility)
+	}
+	n.facility = facility
+
+	return n, nil
+}
+
+func (n syslogNotifier) notify(errors []verificationError) error {
+	conn, err := net.DialTimeout(n.Network, n.Address, syslogTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(syslogTimeout))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range errors {
+		msg := formatSyslogMessage(n.facility, n.AppName, now, e)
+
+		// stream sockets need framing to tell where a message ends, RFC 6587 octet counting
+		if n.Network == "tcp" || n.Network == "unix" {
+			msg = fmt.Sprintf("%d %s", len(msg), msg)
+		}
+
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formatSyslogMessage formats the error as an RFC 5424 message with the check, title and
+// severity as structured data and the title and message of the error as the message
+func formatSyslogMessage(facility int, appName string, ts time.Time, e verificationError) string {
+	severity, ok := syslogSeverities[e.severity]
+	if !ok {
+		severity = syslogSeverities[severityWarning]
+	}
+
+	sd := fmt.Sprintf("[%s check=\"%s\" severity=\"%s\" title=\"%s\"]", syslogSDID,
+		escapeSyslogParam(e.key()), escapeSyslogParam(e.severity), escapeSyslogParam(e.title))
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d - %s %s: %s",
+		facility*8+severity,
+		ts.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(hostname()),
+		syslogHeaderField(appName),
+		os.Getpid(),
+		sd,
+		e.title,
+		strings.TrimRight(e.message, "\n"))
+}
+
+// escapeSyslogParam escapes the characters that are special in a structured data value
+func escapeSyslogParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// syslogHeaderField makes s a valid header field, which is printable ascii without spaces
+func syslogHeaderField(s string) string {
+	f := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if f == "" {
+		return "-"
+	}
+	return f
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSyslogMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := time.Date(2018, 3, 1, 12, 0, 0, 250000000, time.UTC)
+	e := verificationError{title: "Elk verification error", message: "Errors in \"nginx\" [prod]\n", severity: severityCritical, check: "elk:errors"}
+
+	msg := formatSyslogMessage(syslogFacilities["daemon"], "ismonitor", ts, e)
+	expected := fmt.Sprintf(`<26>1 2018-03-01T12:00:00.250000Z %s ismonitor %d - [ismonitor@32473 check="elk:errors" severity="critical" title="Elk verification error"] Elk verification error: Errors in "nginx" [prod]`,
+		syslogHeaderField(hostname()), os.Getpid())
+	assert.Equal(expected, msg)
+
+	e = verificationError{title: `Disk usage "error"]`, message: "Disk usage of / at 92 percent\n", severity: severityWarning}
+	msg = formatSyslogMessage(syslogFacilities["local0"], "my app", ts, e)
+	assert.True(strings.HasPrefix(msg, "<132>1 "), msg)
+	assert.Contains(msg, " my_app ")
+	assert.Contains(msg, `[ismonitor@32473 check="Disk usage \"error\"\]" severity="warning" title="Disk usage \"error\"\]"]`)
+}
+
+func TestSyslogNotifierUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err, fmt.Sprint(err))
+	defer conn.Close()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "syslog", "network": "udp", "address": "%s"}`, conn.LocalAddr()))
+	assert.Nil(n.notify(testErrors()))
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for i, e := range testErrors() {
+		l, _, err := conn.ReadFrom(buf)
+		assert.Nil(err, fmt.Sprint(err))
+		assert.True(strings.HasSuffix(string(buf[:l]), "] "+e.title+": "+strings.TrimRight(e.message, "\n")), fmt.Sprint(i, string(buf[:l])))
+	}
+}
+
+func TestSyslogNotifierTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err, fmt.Sprint(err))
+	defer ln.Close()
+
+	received := make(chan []string)
+	go func() {
+		var msgs []string
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- msgs
+			return
+		}
+		defer conn.Close()
+
+		// octet counted frames
+		r := bufio.NewReader(conn)
+		for {
+			n, err := r.ReadString(' ')
+			if err != nil {
+				break
+			}
+			l, err := strconv.Atoi(strings.TrimSpace(n))
+			if err != nil {
+				break
+			}
+			b := make([]byte, l)
+			_, err = r.Read(b)
+			if err != nil {
+				break
+			}
+			msgs = append(msgs, string(b))
+		}
+		received <- msgs
+	}()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "syslog", "network": "tcp", "address": "%s", "facility": "local3"}`, ln.Addr()))
+	assert.Nil(n.notify(testErrors()))
+
+	msgs := <-received
+	assert.Equal(3, len(msgs))
+	assert.True(strings.HasPrefix(msgs[0], "<156>1 "), msgs[0])
+	assert.True(strings.HasPrefix(msgs[1], "<154>1 "), msgs[1])
+}
+
+func TestSyslogNotifierUnixgram(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	assert.Nil(err, fmt.Sprint(err))
+	defer conn.Close()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "syslog", "address": "%s"}`, path))
+	assert.Nil(n.notify(testErrors()[:1]))
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	l, _, err := conn.ReadFrom(buf)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.True(strings.HasPrefix(string(buf[:l]), "<28>1 "), string(buf[:l]))
+}
+
+func TestMakeSyslogNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	n := makeTestNotifier(t, `{"type": "syslog"}`).(syslogNotifier)
+	assert.Equal("unixgram", n.Network)
+	assert.Equal(defaultSyslogAddress, n.Address)
+	assert.Equal(3, n.facility)
+
+	for _, c := range []string{
+		`{"type": "syslog", "network": "udp"}`,
+		`{"type": "syslog", "network": "sctp", "address": "localhost:514"}`,
+		`{"type": "syslog", "facility": "local8"}`,
+	} {
+		var conf config
+		assert.Nil(json.Unmarshal([]byte(`{"notifiers": [`+c+`]}`), &conf))
+		_, err := makeNotifiers(conf)
+		assert.NotNil(err, c)
+	}
+}
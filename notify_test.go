@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockNotifier struct {
+	mu        sync.Mutex
+	errors    []verificationError
+	recovered []verificationError
+	err       error
+}
+
+func (m *mockNotifier) notify(errors []verificationError) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.errors = append(m.errors, errors...)
+	return m.err
+}
+
+func (m *mockNotifier) notifyRecovered(recovered []verificationError) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.recovered = append(m.recovered, recovered...)
+	return m.err
+}
+
+func TestMakeNotifiersWithoutNotifiersList(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(notifiers))
+	assert.Equal("stdout", notifiers[0].name)
+
+	c.SMTP = &smtpConfiguration{Host: "host", Port: 25, From: "from", To: []string{"to"}}
+	notifiers, err = makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(notifiers))
+	assert.Equal("email", notifiers[0].name)
+}
+
+func TestMakeNotifiers(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	err := json.Unmarshal([]byte(`{
+  "notifiers": [
+    {"type": "email", "name": "ops mail", "host": "mailprovider", "port": 587, "from": "ismonitor@example.com", "to": ["ops@example.com"]},
+    {"type": "stdout", "enabled": false},
+    {"type": "file", "path": "alerts.txt"}
+  ]
+}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(2, len(notifiers))
+	assert.Equal("ops mail", notifiers[0].name)
+	assert.Equal("mailprovider", notifiers[0].notifier.(emailNotifier).config.Host)
+	assert.Equal([]string{"ops@example.com"}, notifiers[0].notifier.(emailNotifier).config.To)
+	assert.Equal("file", notifiers[1].name)
+	assert.Equal(fileNotifier{Path: "alerts.txt"}, notifiers[1].notifier)
+
+	err = json.Unmarshal([]byte(`{"notifiers": [{"type": "carrier pigeon"}]}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err)
+
+	err = json.Unmarshal([]byte(`{"notifiers": [{"type": "file"}]}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "file without path")
+}
+
+func TestReport(t *testing.T) {
+	assert := assert.New(t)
+
+	failing := &mockNotifier{err: fmt.Errorf("connection refused")}
+	working := &mockNotifier{}
+
+	errors := []verificationError{{title: "Title", message: "Error1\n"}}
+	report([]namedNotifier{{"failing", failing}, {"working", working}}, errors, nil)
+
+	assert.Equal(errors, failing.errors)
+	assert.Equal(errors, working.errors)
+
+	// only recoveries
+	recovered := []verificationError{{title: "Title", message: "Error1\n", check: "check"}}
+	report([]namedNotifier{{"failing", failing}, {"working", working}}, nil, recovered)
+
+	assert.Equal(errors, working.errors)
+	assert.Equal(recovered, failing.recovered)
+	assert.Equal(recovered, working.recovered)
+}
+
+func TestWriterNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var b bytes.Buffer
+	err := writerNotifier{&b}.notify([]verificationError{{title: "Title", message: "Error1\n"}, {title: "Title", message: "Error2\n"}})
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("Title\n   Error1\nTitle\n   Error2\n", b.String())
+}
+
+func TestFileNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	n := fileNotifier{Path: filepath.Join(dir, "alerts.txt")}
+	assert.Nil(n.notify([]verificationError{{title: "Title", message: "Error1\n"}}))
+	assert.Nil(n.notify([]verificationError{{title: "Title", message: "Error2\n"}}))
+
+	b, err := ioutil.ReadFile(n.Path)
+	assert.Nil(err, fmt.Sprint(err))
+	lines := strings.Split(string(b), "\n")
+	assert.Equal(7, len(lines), string(b))
+	assert.Equal("Title", lines[1])
+	assert.Equal("   Error1", lines[2])
+	assert.Equal("   Error2", lines[5])
+}
+
+func TestTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("short", truncate("short", 10))
+	assert.Equal("abc", truncate("abcdef", 3))
+	assert.Equal("a", truncate("aåb", 2), "å is two bytes")
+	assert.Equal("aå", truncate("aåb", 3))
+	assert.Equal("", truncate("å", 1))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// quietHours is a time of day when only critical errors are sent, e.g. 22:00 to 07:00
+type quietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is the location the times are in, e.g. Europe/Stockholm, the local time unless set
+	Timezone string `json:"timezone"`
+}
+
+// rateLimit is the maximum number of checks notified per period, e.g. 20 per 1h
+type rateLimit struct {
+	Max    int    `json:"max"`
+	Period string `json:"period"`
+}
+
+// defaultNotifierState is where the throttling state of the notifiers is kept unless configured
+const defaultNotifierState = "notifier_state.json"
+
+// throttleMu serializes the updates of the notifier state file by the notifiers, which run at
+// the same time
+var throttleMu sync.Mutex
+
+// throttledNotifier holds back errors before they reach the notifier. During quiet hours only
+// critical errors are sent. Errors of a check notified less than minInterval ago are dropped.
+// The checks over the rate limit are counted, and the count is added as an error of its own to
+// the next errors that are sent.
+type throttledNotifier struct {
+	notifier
+	name        string
+	stateFile   string
+	quietStart  time.Duration
+	quietEnd    time.Duration
+	location    *time.Location
+	quiet       bool
+	rateMax     int
+	ratePeriod  time.Duration
+	minInterval time.Duration
+	now         func() time.Time
+}
+
+// throttleState is what a throttled notifier remembers between runs
+type throttleState struct {
+	// Sent are the times of the checks notified within the rate limit period
+	Sent []time.Time `json:"sent"`
+	// LastNotified is when each check was last notified
+	LastNotified map[string]time.Time `json:"last_notified"`
+	// Suppressed is the number of checks over the rate limit not yet told about
+	Suppressed int `json:"suppressed"`
+}
+
+func (c notifierConfiguration) throttled() bool {
+	return c.QuietHours != nil || c.RateLimit != nil || c.MinInterval != ""
+}
+
+func (c config) notifierStateFile() string {
+	if c.NotifierState != "" {
+		return c.NotifierState
+	}
+	return defaultNotifierState
+}
+
+func makeThrottledNotifier(c notifierConfiguration, n notifier, stateFile string) (notifier, error) {
+	t := throttledNotifier{notifier: n, name: c.name(), stateFile: stateFile, location: time.Local, now: time.Now}
+
+	if q := c.QuietHours; q != nil {
+		var err error
+		t.quiet = true
+		t.quietStart, err = parseTimeOfDay(q.Start)
+		if err != nil {
+			return nil, fmt.Errorf("quiet_hours has an invalid start: %s", fmt.Sprint(err))
+		}
+		t.quietEnd, err = parseTimeOfDay(q.End)
+		if err != nil {
+			return nil, fmt.Errorf("quiet_hours has an invalid end: %s", fmt.Sprint(err))
+		}
+		if q.Timezone != "" {
+			t.location, err = time.LoadLocation(q.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("quiet_hours has an invalid timezone: %s", fmt.Sprint(err))
+			}
+		}
+	}
+
+	if r := c.RateLimit; r != nil {
+		if r.Max <= 0 {
+			return nil, fmt.Errorf("rate_limit requires max")
+		}
+		period, err := time.ParseDuration(r.Period)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("rate_limit has an invalid period '%s'", r.Period)
+		}
+		t.rateMax = r.Max
+		t.ratePeriod = period
+	}
+
+	if c.MinInterval != "" {
+		d, err := time.ParseDuration(c.MinInterval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid min_interval '%s'", c.MinInterval)
+		}
+		t.minInterval = d
+	}
+
+	return t, nil
+}
+
+// parseTimeOfDay parses e.g. 22:30 as the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inQuietHours tells if ts is within the quiet hours, which may span midnight
+func (n throttledNotifier) inQuietHours(ts time.Time) bool {
+	if !n.quiet {
+		return false
+	}
+
+	local := ts.In(n.location)
+	t := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	if n.quietStart <= n.quietEnd {
+		return t >= n.quietStart && t < n.quietEnd
+	}
+	return t >= n.quietStart || t < n.quietEnd
+}
+
+func (n throttledNotifier) notify(errors []verificationError) error {
+	_, err := n.notifySent(errors)
+	return err
+}
+
+// notifySent sends the errors that aren't held back and returns those that were sent, without
+// the count of those suppressed by the rate limit
+func (n throttledNotifier) notifySent(errors []verificationError) ([]verificationError, error) {
+	throttleMu.Lock()
+	states, err := loadThrottleStates(n.stateFile)
+	throttleMu.Unlock()
+	if err != nil {
+		log.Printf("Failed to read notifier state, starting over: %s\n", fmt.Sprint(err))
+		states = make(map[string]throttleState)
+	}
+
+	state := states[n.name]
+	send, sent := n.filter(&state, errors, n.now())
+
+	// the state is only saved once the errors are sent, so that errors that failed to be sent
+	// don't use up the rate limit or min_interval
+	if len(send) > 0 {
+		err = n.notifier.notify(send)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n.saveState(state)
+	return sent, nil
+}
+
+// saveState replaces the state of the notifier in the state file, leaving those of the other
+// notifiers as they are
+func (n throttledNotifier) saveState(state throttleState) {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	states, err := loadThrottleStates(n.stateFile)
+	if err != nil {
+		states = make(map[string]throttleState)
+	}
+	states[n.name] = state
+
+	err = writeJSONFile(n.stateFile, states)
+	if err != nil {
+		log.Printf("Failed to save notifier state: %s\n", fmt.Sprint(err))
+	}
+}
+
+// notifyRecovered passes the recoveries on, except those of warnings during quiet hours
+func (n throttledNotifier) notifyRecovered(recovered []verificationError) error {
+	r, ok := n.notifier.(recoveryNotifier)
+	if !ok {
+		return nil
+	}
+
+	quiet := n.inQuietHours(n.now())
+	var send []verificationError
+	for _, e := range recovered {
+		if !quiet || e.severity == severityCritical {
+			send = append(send, e)
+		}
+	}
+
+	if len(send) == 0 {
+		return nil
+	}
+	return r.notifyRecovered(send)
+}
+
+// filter returns the errors to send, with the count of those suppressed by the rate limit if any,
+// and the errors among them that were passed to it, and updates the state accordingly
+func (n throttledNotifier) filter(state *throttleState, errors []verificationError, now time.Time) ([]verificationError, []verificationError) {
+	if state.LastNotified == nil {
+		state.LastNotified = make(map[string]time.Time)
+	}
+
+	quiet := n.inQuietHours(now)
+
+	var send []verificationError
+	for _, e := range errors {
+		if quiet && e.severity != severityCritical {
+			continue
+		}
+		if last, ok := state.LastNotified[e.key()]; ok && n.minInterval > 0 && now.Sub(last) < n.minInterval {
+			continue
+		}
+		send = append(send, e)
+	}
+
+	if n.rateMax > 0 {
+		var sent []time.Time
+		for _, t := range state.Sent {
+			if now.Sub(t) < n.ratePeriod {
+				sent = append(sent, t)
+			}
+		}
+		state.Sent = sent
+
+		// the rate limit counts the checks notified, and the errors of a check are either all
+		// sent or suppressed
+		room := n.rateMax - len(state.Sent)
+		notified := make(map[string]bool)
+		suppressed := make(map[string]bool)
+		var limited []verificationError
+		for _, e := range send {
+			k := e.key()
+			if !notified[k] && !suppressed[k] {
+				if len(notified) < room {
+					notified[k] = true
+					state.Sent = append(state.Sent, now)
+				} else {
+					suppressed[k] = true
+				}
+			}
+			if notified[k] {
+				limited = append(limited, e)
+			}
+		}
+		state.Suppressed += len(suppressed)
+		send = limited
+	}
+
+	for k, t := range state.LastNotified {
+		if now.Sub(t) >= n.minInterval {
+			delete(state.LastNotified, k)
+		}
+	}
+	if n.minInterval > 0 {
+		for _, e := range send {
+			state.LastNotified[e.key()] = now
+		}
+	}
+
+	passed := send
+	if len(send) > 0 && state.Suppressed > 0 {
+		send = append(send[:len(send):len(send)], verificationError{
+			title:    "Alerts suppressed",
+			message:  fmt.Sprintf("and %d more %s suppressed by the rate limit\n", state.Suppressed, pluralize(state.Suppressed, "alert", "alerts")),
+			severity: severityWarning,
+		})
+		state.Suppressed = 0
+	}
+
+	return send, passed
+}
+
+func loadThrottleStates(file string) (map[string]throttleState, error) {
+	states := make(map[string]throttleState)
+
+	err := readJSONFile(file, &states)
+	if err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuietHours(t *testing.T) {
+	assert := assert.New(t)
+
+	n, err := makeThrottledNotifier(notifierConfiguration{Type: "stdout", QuietHours: &quietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Stockholm"}}, &mockNotifier{}, "")
+	assert.Nil(err, fmt.Sprint(err))
+	tn := n.(throttledNotifier)
+
+	// 21:30 UTC is 22:30 in Stockholm in the winter
+	assert.True(tn.inQuietHours(time.Date(2018, 1, 10, 21, 30, 0, 0, time.UTC)))
+	assert.True(tn.inQuietHours(time.Date(2018, 1, 10, 5, 59, 0, 0, time.UTC)))
+	assert.False(tn.inQuietHours(time.Date(2018, 1, 10, 6, 0, 0, 0, time.UTC)))
+	assert.False(tn.inQuietHours(time.Date(2018, 1, 10, 20, 59, 0, 0, time.UTC)))
+
+	n, err = makeThrottledNotifier(notifierConfiguration{Type: "stdout", QuietHours: &quietHours{Start: "12:00", End: "13:00", Timezone: "UTC"}}, &mockNotifier{}, "")
+	assert.Nil(err, fmt.Sprint(err))
+	tn = n.(throttledNotifier)
+	assert.True(tn.inQuietHours(time.Date(2018, 1, 10, 12, 30, 0, 0, time.UTC)))
+	assert.False(tn.inQuietHours(time.Date(2018, 1, 10, 13, 0, 0, 0, time.UTC)))
+
+	_, err = makeThrottledNotifier(notifierConfiguration{QuietHours: &quietHours{Start: "25:00", End: "07:00"}}, &mockNotifier{}, "")
+	assert.NotNil(err)
+	_, err = makeThrottledNotifier(notifierConfiguration{QuietHours: &quietHours{Start: "22:00", End: "07:00", Timezone: "Nowhere/Special"}}, &mockNotifier{}, "")
+	assert.NotNil(err)
+	_, err = makeThrottledNotifier(notifierConfiguration{RateLimit: &rateLimit{Period: "1h"}}, &mockNotifier{}, "")
+	assert.NotNil(err, "rate limit without max")
+	_, err = makeThrottledNotifier(notifierConfiguration{MinInterval: "often"}, &mockNotifier{}, "")
+	assert.NotNil(err)
+}
+
+func TestThrottledNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 1, 10, 12, 0, 0, 0, time.UTC)
+	m := &mockNotifier{}
+	c := notifierConfiguration{
+		Type:        "stdout",
+		QuietHours:  &quietHours{Start: "22:00", End: "07:00", Timezone: "UTC"},
+		RateLimit:   &rateLimit{Max: 3, Period: "1h"},
+		MinInterval: "30m",
+	}
+	n, err := makeThrottledNotifier(c, m, filepath.Join(dir, "notifier_state.json"))
+	assert.Nil(err, fmt.Sprint(err))
+	tn := n.(throttledNotifier)
+	tn.now = func() time.Time { return now }
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+	}
+
+	err = tn.notify(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(errors, m.errors)
+
+	// the same checks within min_interval are dropped
+	m.errors = nil
+	now = now.Add(10 * time.Minute)
+	err = tn.notify(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(0, len(m.errors))
+
+	// over the rate limit the errors are counted, and the count sent along
+	more := []verificationError{
+		{title: "Loki verification error", message: "a\n", check: "loki:a", severity: severityWarning},
+		{title: "Loki verification error", message: "b\n", check: "loki:b", severity: severityWarning},
+		{title: "Loki verification error", message: "c\n", check: "loki:c", severity: severityWarning},
+	}
+	err = tn.notify(more)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(2, len(m.errors))
+	assert.Equal(more[0], m.errors[0])
+	assert.Equal("Alerts suppressed", m.errors[1].title)
+	assert.Equal("and 2 more alerts suppressed by the rate limit\n", m.errors[1].message)
+
+	// or with the next errors sent if none could be sent
+	m.errors = nil
+	err = tn.notify(more[1:])
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(0, len(m.errors))
+
+	now = now.Add(time.Hour)
+	err = tn.notify(errors[:1])
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(2, len(m.errors))
+	assert.Equal("docker:nginx", m.errors[0].check)
+	assert.Equal("and 2 more alerts suppressed by the rate limit\n", m.errors[1].message)
+
+	// only critical errors and recoveries during quiet hours
+	m.errors = nil
+	now = time.Date(2018, 1, 10, 23, 0, 0, 0, time.UTC)
+	err = tn.notify(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(errors[:1], m.errors)
+
+	err = tn.notifyRecovered(errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(errors[:1], m.recovered)
+
+	// notifiers without recoveries stay that way
+	n, err = makeThrottledNotifier(c, writerNotifier{ioutil.Discard}, filepath.Join(dir, "notifier_state.json"))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Nil(n.(recoveryNotifier).notifyRecovered(errors))
+}
+
+func TestThrottledNotifierChecks(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 1, 10, 12, 0, 0, 0, time.UTC)
+	m := &mockNotifier{err: fmt.Errorf("connection refused")}
+	c := notifierConfiguration{Type: "stdout", RateLimit: &rateLimit{Max: 2, Period: "1h"}, MinInterval: "30m"}
+	n, err := makeThrottledNotifier(c, m, filepath.Join(dir, "notifier_state.json"))
+	assert.Nil(err, fmt.Sprint(err))
+	tn := n.(throttledNotifier)
+	tn.now = func() time.Time { return now }
+
+	errors := []verificationError{
+		{title: "Elk verification error", message: "a\n", check: "elk:errors", severity: severityWarning},
+		{title: "Elk verification error", message: "b\n", check: "elk:errors", severity: severityWarning},
+		{title: "Elk verification error", message: "c\n", check: "elk:errors", severity: severityWarning},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", check: "disk:/", severity: severityWarning},
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", check: "docker:nginx", severity: severityWarning},
+	}
+
+	// errors that fail to be sent use up neither the rate limit nor min_interval
+	assert.NotNil(tn.notify(errors))
+	m.err = nil
+	m.errors = nil
+	assert.Nil(tn.notify(errors))
+
+	// the rate limit counts checks, and keeps the errors of a check together
+	assert.Equal(5, len(m.errors))
+	assert.Equal(errors[:4], m.errors[:4])
+	assert.Equal("and 1 more alert suppressed by the rate limit\n", m.errors[4].message)
+}
+
+func TestMakeNotifiersThrottled(t *testing.T) {
+	assert := assert.New(t)
+
+	c := config{NotifierState: "state.json", Notifiers: []notifierConfiguration{{Type: "stdout", MinInterval: "1h"}, {Type: "stdout"}}}
+	notifiers, err := makeNotifiers(c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(2, len(notifiers))
+	assert.Equal("state.json", notifiers[0].notifier.(throttledNotifier).stateFile)
+	_, ok := notifiers[1].notifier.(throttledNotifier)
+	assert.False(ok)
+}
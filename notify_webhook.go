@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// webhookNotifier sends the errors to any http endpoint, with the body and the headers given as
+// templates executed with alertTemplateData
+type webhookNotifier struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// Body defaults to the alertTemplateData as json
+	Body       string `json:"body"`
+	MaxRetries *int   `json:"max_retries"`
+
+	body      *template.Template
+	headers   map[string]*template.Template
+	retryWait time.Duration
+}
+
+const defaultWebhookBody = "{{json .}}"
+
+func makeWebhookNotifier(c notifierConfiguration) (notifier, error) {
+	n := webhookNotifier{Method: "POST", retryWait: time.Second}
+	err := c.settings(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n.URL == "" {
+		return nil, fmt.Errorf("webhook notifier requires url")
+	}
+	if n.MaxRetries == nil {
+		retries := defaultMaxRetries
+		n.MaxRetries = &retries
+	}
+
+	body := n.Body
+	if body == "" {
+		body = defaultWebhookBody
+	}
+	n.body, err = parseAlertTemplate("body", body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse body template: %s", fmt.Sprint(err))
+	}
+
+	n.headers = make(map[string]*template.Template)
+	for k, v := range n.Headers {
+		n.headers[k], err = parseAlertTemplate(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template of header %s: %s", k, fmt.Sprint(err))
+		}
+	}
+
+	return n, nil
+}
+
+func (n webhookNotifier) notify(errors []verificationError) error {
+	data := makeAlertTemplateData(errors, time.Now())
+
+	body, err := executeAlertTemplate(n.body, data)
+	if err != nil {
+		return fmt.Errorf("failed to execute body template: %s", fmt.Sprint(err))
+	}
+
+	headers := map[string]string{"Content-Type": "application/json"}
+	for k, tmpl := range n.headers {
+		headers[http.CanonicalHeaderKey(k)], err = executeAlertTemplate(tmpl, data)
+		if err != nil {
+			return fmt.Errorf("failed to execute template of header %s: %s", k, fmt.Sprint(err))
+		}
+	}
+
+	return sendWithRetry(n.Method, n.URL, headers, []byte(body), *n.MaxRetries, n.retryWait)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookRequest struct {
+	method string
+	header http.Header
+	body   string
+}
+
+func newWebhookServer(t *testing.T, requests *[]webhookRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*requests = append(*requests, webhookRequest{r.Method, r.Header, string(b)})
+	}))
+}
+
+func makeTestNotifier(t *testing.T, notifierJSON string) notifier {
+	var c config
+	err := json.Unmarshal([]byte(`{"notifiers": [`+notifierJSON+`]}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifiers, err := makeNotifiers(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifiers[0].notifier
+}
+
+func TestWebhookNotifierDefaultBody(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests []webhookRequest
+	server := newWebhookServer(t, &requests)
+	defer server.Close()
+
+	n := makeTestNotifier(t, fmt.Sprintf(`{"type": "webhook", "url": "%s"}`, server.URL))
+	assert.Nil(n.notify(testErrors()))
+
+	assert.Equal(1, len(requests))
+	assert.Equal("POST", requests[0].method)
+	assert.Equal("application/json", requests[0].header.Get("Content-Type"))
+
+	var data alertTemplateData
+	assert.Nil(json.Unmarshal([]byte(requests[0].body), &data))
+	assert.Equal(hostname(), data.Hostname)
+	assert.Equal(3, len(data.Errors))
+	assert.Equal(alertData{Title: "Docker verification error", Message: "Docker container 'nginx' is not running", Severity: "critical"}, data.Errors[1])
+}
+
+func TestWebhookNotifierTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests []webhookRequest
+	server := newWebhookServer(t, &requests)
+	defer server.Close()
+
+	// ntfy takes the message as plain text and the rest as headers
+	n := makeTestNotifier(t, fmt.Sprintf(`{
+  "type": "webhook",
+  "url": "%s/ismonitor",
+  "method": "PUT",
+  "headers": {
+    "content-type": "text/plain",
+    "X-Title": "ismonitor on {{.Hostname}}",
+    "X-Priority": "{{range .Groups}}{{if eq .Severity \"critical\"}}urgent{{end}}{{end}}"
+  },
+  "body": "{{range .Groups}}{{.Title}}:{{range .Errors}} {{.Message}}{{end}}\n{{end}}"
+}`, server.URL))
+	assert.Nil(n.notify(testErrors()))
+
+	assert.Equal(1, len(requests))
+	assert.Equal("PUT", requests[0].method)
+	assert.Equal("text/plain", requests[0].header.Get("Content-Type"))
+	assert.Equal("ismonitor on "+hostname(), requests[0].header.Get("X-Title"))
+	assert.Equal("urgent", requests[0].header.Get("X-Priority"))
+	assert.Equal("Disk usage verification error: Disk usage of / at 92 percent Disk usage of /boot at 85 percent\nDocker verification error: Docker container 'nginx' is not running\n", requests[0].body)
+
+	// a discord style json body with the values properly quoted
+	n = makeTestNotifier(t, fmt.Sprintf(`{
+  "type": "webhook",
+  "url": "%s",
+  "body": "{\"content\": {{json (printf \"%%d errors on %%s\" (len .Errors) .Hostname)}}, \"embeds\": [{{range $i, $e := .Errors}}{{if $i}},{{end}}{\"title\": {{json $e.Title}}, \"description\": {{json $e.Message}}}{{end}}]}"
+}`, server.URL))
+	assert.Nil(n.notify(testErrors()))
+
+	assert.Equal(2, len(requests))
+	var discord struct {
+		Content string `json:"content"`
+		Embeds  []struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+		} `json:"embeds"`
+	}
+	assert.Nil(json.Unmarshal([]byte(requests[1].body), &discord), requests[1].body)
+	assert.Equal("3 errors on "+hostname(), discord.Content)
+	assert.Equal(3, len(discord.Embeds))
+	assert.Equal("Docker container 'nginx' is not running", discord.Embeds[1].Description)
+}
+
+func TestMakeWebhookNotifier(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "webhook"}]}`), &c))
+	_, err := makeNotifiers(c)
+	assert.NotNil(err, "no url")
+
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "webhook", "url": "http://localhost", "body": "{{.Hostname"}]}`), &c))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "invalid body template")
+
+	assert.Nil(json.Unmarshal([]byte(`{"notifiers": [{"type": "webhook", "url": "http://localhost", "headers": {"X-Title": "{{end}}"}}]}`), &c))
+	_, err = makeNotifiers(c)
+	assert.NotNil(err, "invalid header template")
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/smtp"
+	"math/rand"
 	"os"
 	"os/exec"
 	"time"
@@ -13,18 +13,138 @@ import (
 	"github.com/robfig/cron"
 )
 
+const (
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
 type verificationError struct {
-	title   string
-	message string
+	title    string
+	message  string
+	severity string
+	// check identifies the check the error comes from between runs, e.g. docker:nginx, to tell
+	// when it has recovered
+	check    string
+	incident incidentRef
+	// since is when the check started failing, and acknowledged tells that someone is looking
+	// into it, both from the alert state
+	since        time.Time
+	acknowledged bool
+	// dependsOn are the checks that failing cause this one to fail too
+	dependsOn  []string
+	thresholds thresholdOptions
+	// pending is set for errors not to be notified yet, see updateAlerts
+	pending bool
+	// notified are the notifiers of the escalation tiers told about the alert, set on recoveries
+	notified []string
+	// reported tells that the alert has been notified, set on recoveries
+	reported bool
+}
+
+// key identifies the alert the error belongs to
+func (e verificationError) key() string {
+	if e.check != "" {
+		return e.check
+	}
+	return e.title
+}
+
+// checkOptions are the settings shared by the checks configured as lists, e.g. elk
+type checkOptions struct {
+	// Name identifies the check in alerts. It defaults to the notification message, or the
+	// query or path if there is none, so it needs to be set to keep two such checks apart.
+	Name string `json:"name"`
+	// Severity of the errors of the check, warning unless configured
+	Severity string `json:"severity"`
+	// DependsOn are the checks this one can't pass without, e.g. docker:elk. While any of them
+	// fails the errors of this check are only mentioned with theirs.
+	DependsOn []string `json:"depends_on"`
+	thresholdOptions
+	checkSchedule
+}
+
+func (o checkOptions) severity() string {
+	if o.Severity == "" {
+		return severityWarning
+	}
+	return o.Severity
+}
+
+func validateCheckOptions(o checkOptions) error {
+	err := validateThresholdOptions(o.thresholdOptions)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range o.DependsOn {
+		if d == "" {
+			return fmt.Errorf("depends_on has an empty check")
+		}
+	}
+
+	switch o.Severity {
+	case "", severityWarning, severityCritical:
+		return nil
+	default:
+		return fmt.Errorf("unknown severity '%s', expected %s or %s", o.Severity, severityWarning, severityCritical)
+	}
+}
+
+// withSeverity sets the severity of the errors
+func withSeverity(errors []verificationError, severity string) []verificationError {
+	for i := range errors {
+		errors[i].severity = severity
+	}
+	return errors
+}
+
+// checkKey is the check the errors come from, check or, if the check has a name, its type and
+// name, e.g. elk:errors
+func (o checkOptions) checkKey(check string) string {
+	if o.Name != "" {
+		checkType, _ := splitCheck(check)
+		return checkType + ":" + o.Name
+	}
+	return check
+}
+
+// apply sets the severity of the errors, the check they come from, see checkKey, and its
+// dependencies
+func (o checkOptions) apply(errors []verificationError, check string) []verificationError {
+	check = o.checkKey(check)
+	for i := range errors {
+		errors[i].severity = o.severity()
+		errors[i].check = check
+		errors[i].dependsOn = o.DependsOn
+		errors[i].thresholds = o.thresholdOptions
+	}
+	return errors
 }
 
 type config struct {
-	CronSchedule              *string            `json:"cron_schedule"`
-	SMTP                      *smtpConfiguration `json:"smtp"`
-	DockerContainers          []string           `json:"docker_containers"`
-	DiskUsagePercentWarning   int                `json:"disk_usage_percent_warning"`
-	UptimeLoad5MinutesWarning float64            `json:"uptime_load_5_minutes_warning"`
-	ElkConfiguration          []elkConfiguration `json:"elk"`
+	CronSchedule              *string                 `json:"cron_schedule"`
+	SMTP                      *smtpConfiguration      `json:"smtp"`
+	DockerContainers          []string                `json:"docker_containers"`
+	DiskUsagePercentWarning   int                     `json:"disk_usage_percent_warning"`
+	UptimeLoad5MinutesWarning float64                 `json:"uptime_load_5_minutes_warning"`
+	ElkConfiguration          []elkConfiguration      `json:"elk"`
+	LokiConfiguration         []lokiConfiguration     `json:"loki"`
+	LogFiles                  []logFileConfiguration  `json:"log_files"`
+	LogFileOffsets            string                  `json:"log_file_offsets"`
+	Journal                   []journalConfiguration  `json:"journal"`
+	Notifiers                 []notifierConfiguration `json:"notifiers"`
+	AlertState                string                  `json:"alert_state"`
+	History                   string                  `json:"history"`
+	NotifierState             string                  `json:"notifier_state"`
+	Escalation                []escalationTier        `json:"escalation"`
+	Silences                  string                  `json:"silences"`
+	Maintenance               []maintenanceWindow     `json:"maintenance"`
+	// Thresholds are the thresholds of the docker, disk and load checks by type or check
+	Thresholds map[string]thresholdOptions `json:"thresholds"`
+	// Schedules are the schedules of the docker, disk and load checks
+	Schedules map[string]checkSchedule `json:"schedules"`
+	API       *apiConfiguration        `json:"api"`
+	Digest    *digestConfiguration     `json:"digest"`
 }
 
 type smtpConfiguration struct {
@@ -33,23 +153,45 @@ type smtpConfiguration struct {
 	Auth *smtpAuth `json:"auth"`
 	From string    `json:"from"`
 	To   []string  `json:"to"`
+	// TLS is opportunistic (default), starttls, implicit or none
+	TLS string `json:"tls"`
+	// CAFile is a PEM file with the certificates to verify the server with instead of the
+	// system ones
+	CAFile string `json:"ca_file"`
+	// HELO is the name to greet the server with, defaults to localhost
+	HELO    string `json:"helo"`
+	Timeout string `json:"timeout"`
+	// Subject and Body are templates executed with the same data as the webhook templates
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+	// RecoverySubject is the subject template of the mail telling that checks have recovered
+	RecoverySubject string `json:"recovery_subject"`
 }
 
 type smtpAuth struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// Mechanism is plain (default), login or cram-md5
+	Mechanism string `json:"mechanism"`
 }
 
+// monitorJob runs the checks sharing a schedule, after a random delay of up to jitter
 type monitorJob struct {
 	config *config
+	checks []scheduledCheck
+	jitter time.Duration
 }
 
 func (t monitorJob) Run() {
 	//log.Println("Doing scheduled execution")
-	runIsmonitor(*t.config)
+	if t.jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(t.jitter))))
+	}
+	runChecks(*t.config, t.checks)
 }
 
-func startIsmonitor(daemonMode bool) {
+// loadConfig reads and validates config.json, quitting if it can't be used
+func loadConfig() config {
 	configFile, err := ioutil.ReadFile("config.json")
 	if err != nil {
 		log.Fatalln(err)
@@ -61,7 +203,38 @@ func startIsmonitor(daemonMode bool) {
 		log.Fatalln(err)
 	}
 
-	if daemonMode && config.CronSchedule == nil {
+	err = validateConfig(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return config
+}
+
+// startDigest sends the digest once, for running it from cron
+func startDigest() {
+	config := loadConfig()
+
+	err := sendDigest(config, time.Now())
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// startCommand runs a subcommand, see runCommand
+func startCommand(args []string) {
+	config := loadConfig()
+
+	err := runCommand(config, args, time.Now(), os.Stdout)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func startIsmonitor(daemonMode bool) {
+	config := loadConfig()
+
+	if daemonMode && config.CronSchedule == nil && !allChecksScheduled(config) {
 		fmt.Println("Daemon mode but no cron schedule specified. Quitting.")
 		os.Exit(1)
 	}
@@ -70,9 +243,17 @@ func startIsmonitor(daemonMode bool) {
 		os.Exit(1)
 	}
 
-	if config.CronSchedule != nil {
+	if daemonMode {
+		if config.API != nil {
+			go serveAPI(config)
+		}
 		cron := cron.New()
-		cron.AddJob(*config.CronSchedule, monitorJob{&config})
+		for _, job := range makeMonitorJobs(&config) {
+			cron.AddJob(job.spec, job.monitorJob)
+		}
+		if config.Digest != nil && config.Digest.CronSchedule != "" {
+			cron.AddJob(config.Digest.CronSchedule, digestJob{&config})
+		}
 		cron.Start()
 		defer cron.Stop()
 		select {}
@@ -81,60 +262,150 @@ func startIsmonitor(daemonMode bool) {
 	}
 }
 
-func runIsmonitor(config config) {
-	var errors []verificationError
+// validateConfig rejects configurations that can't be acted upon
+func validateConfig(config config) error {
+	for _, c := range config.ElkConfiguration {
+		err := validateElkConfiguration(c)
+		if err == nil {
+			err = validateCheckOptions(c.checkOptions)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range config.LokiConfiguration {
+		err := validateLokiConfiguration(c)
+		if err == nil {
+			err = validateCheckOptions(c.checkOptions)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range config.LogFiles {
+		err := validateLogFileConfiguration(c)
+		if err == nil {
+			err = validateCheckOptions(c.checkOptions)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range config.Journal {
+		err := validateJournalConfiguration(c)
+		if err == nil {
+			err = validateCheckOptions(c.checkOptions)
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-	// 1. Verify running docker containers
-	// $ sudo docker inspect --format='{{.Name}}' $(sudo docker ps -q --no-trunc)
-	o, err := exec.Command("bash", "-c", "docker inspect --format='{{.Name}}' $(docker ps -q --no-trunc)").Output()
-	if err != nil {
-		e := verificationError{title: "Docker verification error", message: fmt.Sprintf("Failed to run docker command: %s\n", fmt.Sprint(err))}
-		errors = append(errors, e)
+	for check, t := range config.Thresholds {
+		err := validateThresholdOptions(t)
+		if err != nil {
+			return fmt.Errorf("thresholds of %s: %s", check, fmt.Sprint(err))
+		}
 	}
-	runningDockerErrors := verifyRunningDockerContainers(string(o), config.DockerContainers)
-	errors = append(errors, runningDockerErrors...)
 
-	// 2. Verify free space
-	// df --output='source,pcent,target'
-	o2, err := exec.Command("bash", "-c", "df --output='source,pcent,target'").Output() // need to run through bash to work on linux for some reason
+	err := validateSchedules(config)
 	if err != nil {
-		e := verificationError{title: "Disk usage verification error", message: fmt.Sprintf("Failed to run df command: %s\n", fmt.Sprint(err))}
-		errors = append(errors, e)
+		return err
+	}
+
+	for _, w := range config.Maintenance {
+		err := validateMaintenanceWindow(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.API != nil && config.API.Listen == "" {
+		return fmt.Errorf("api requires listen")
+	}
+
+	if config.Digest != nil {
+		err := validateDigestConfiguration(config)
+		if err != nil {
+			return err
+		}
 	}
-	freeSpaceErrors := verifyFreeSpace(string(o2), config.DiskUsagePercentWarning)
-	errors = append(errors, freeSpaceErrors...)
 
-	// 3. Verify load average
-	o3, err := ioutil.ReadFile("/proc/loadavg")
+	_, err = makeNotifiers(config)
 	if err != nil {
-		e := verificationError{title: "Load average verification error", message: fmt.Sprintf("Failed to read /proc/loadavg: %s\n", fmt.Sprint(err))}
-		errors = append(errors, e)
+		return err
 	}
-	uptimeErrors := verifyLoadAvg(string(o3), config.UptimeLoad5MinutesWarning)
-	errors = append(errors, uptimeErrors...)
 
-	elkErrors := doElkVerifications(config)
-	errors = append(errors, elkErrors...)
+	return nil
+}
+
+// runIsmonitor runs all checks once
+func runIsmonitor(config config) {
+	runChecks(config, makeScheduledChecks(config))
+}
 
-	// report errors if any
-	if len(errors) > 0 {
-		err = report(config.SMTP, errors)
+// runChecks runs the checks and reports their errors, and the recoveries of the alerts of these
+// checks
+func runChecks(config config, checks []scheduledCheck) {
+	var errors []verificationError
+	for _, c := range checks {
+		errors = append(errors, c.run(config)...)
+	}
+
+	for i := range errors {
+		if errors[i].severity == "" {
+			errors[i].severity = severityWarning
+		}
+	}
+
+	errors = applyThresholds(config.Thresholds, errors)
+
+	now := time.Now()
+	errors, recovered := updateAlerts(config, errors, now, runScope(config, checks))
+
+	// report errors and recoveries if any
+	if len(errors) > 0 || len(recovered) > 0 {
+		notifiers, err := makeNotifiers(config)
 		if err != nil {
 			log.Printf("Failed to report errors: %s\n", fmt.Sprint(err))
+			return
 		}
+		report(notifiers, errors, recovered)
 	}
 }
 
-func report(smtpConfig *smtpConfiguration, errors []verificationError) error {
-	var err error
-	if smtpConfig == nil {
-		// report to console
-		for _, e := range errors {
-			fmt.Printf("%s\n   %s", e.title, e.message)
-		}
-	} else {
-		err = sendEmail(smtp.SendMail, *smtpConfig, time.Now(), errors)
+func doDockerVerifications(config config) []verificationError {
+	var errors []verificationError
+
+	// $ sudo docker inspect --format='{{.Name}}' $(sudo docker ps -q --no-trunc)
+	o, err := exec.Command("bash", "-c", "docker inspect --format='{{.Name}}' $(docker ps -q --no-trunc)").Output()
+	if err != nil {
+		e := verificationError{title: "Docker verification error", message: fmt.Sprintf("Failed to run docker command: %s\n", fmt.Sprint(err)), check: "docker"}
+		errors = append(errors, e)
 	}
+	runningDockerErrors := verifyRunningDockerContainers(string(o), config.DockerContainers)
+	return append(errors, withSeverity(runningDockerErrors, severityCritical)...)
+}
+
+func doDiskVerifications(config config) []verificationError {
+	var errors []verificationError
 
-	return err
+	// df --output='source,pcent,target'
+	o, err := exec.Command("bash", "-c", "df --output='source,pcent,target'").Output() // need to run through bash to work on linux for some reason
+	if err != nil {
+		e := verificationError{title: "Disk usage verification error", message: fmt.Sprintf("Failed to run df command: %s\n", fmt.Sprint(err)), check: "disk"}
+		errors = append(errors, e)
+	}
+	return append(errors, verifyFreeSpace(string(o), config.DiskUsagePercentWarning)...)
+}
+
+func doLoadVerifications(config config) []verificationError {
+	var errors []verificationError
+
+	o, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		e := verificationError{title: "Load average verification error", message: fmt.Sprintf("Failed to read /proc/loadavg: %s\n", fmt.Sprint(err)), check: "load"}
+		errors = append(errors, e)
+	}
+	return append(errors, verifyLoadAvg(string(o), config.UptimeLoad5MinutesWarning)...)
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// checkSchedule is when a check runs in daemon mode, a cron expression such as "0 */5 * * * *"
+// or an interval such as 5m, and a random delay of up to Jitter before each run for checks on
+// many hosts not to run at the same time. Checks without a schedule run on cron_schedule.
+type checkSchedule struct {
+	Schedule string `json:"schedule"`
+	Jitter   string `json:"jitter"`
+}
+
+// spec returns the schedule as understood by cron, which is defaultSpec if there is none
+func (s checkSchedule) spec(defaultSpec *string) string {
+	if s.Schedule == "" {
+		if defaultSpec == nil {
+			return ""
+		}
+		return *defaultSpec
+	}
+	if _, err := time.ParseDuration(s.Schedule); err == nil {
+		return "@every " + s.Schedule
+	}
+	return s.Schedule
+}
+
+func (s checkSchedule) jitter() time.Duration {
+	d, _ := time.ParseDuration(s.Jitter)
+	return d
+}
+
+// validateCheckSchedule verifies the schedule, and that the jitter is shorter than the time
+// between the runs for a run not to start before the previous. defaultSpec is cron_schedule.
+func validateCheckSchedule(s checkSchedule, defaultSpec *string) error {
+	if spec := s.spec(nil); spec != "" {
+		_, err := cron.Parse(spec)
+		if err != nil {
+			return fmt.Errorf("invalid schedule '%s': %s", s.Schedule, fmt.Sprint(err))
+		}
+	}
+	if s.Jitter != "" {
+		d, err := time.ParseDuration(s.Jitter)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid jitter '%s'", s.Jitter)
+		}
+		if spec := s.spec(defaultSpec); spec != "" && d > 0 {
+			interval, err := shortestInterval(spec)
+			if err == nil && d >= interval {
+				return fmt.Errorf("invalid jitter '%s', it isn't shorter than the %s between runs", s.Jitter, interval)
+			}
+		}
+	}
+	return nil
+}
+
+// shortestInterval returns the shortest time between the runs of the schedule, which differs
+// between runs for cron expressions such as "0 0 6,18 * * *"
+func shortestInterval(spec string) (time.Duration, error) {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return 0, err
+	}
+
+	var shortest time.Duration
+	next := schedule.Next(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	for i := 0; i < 100; i++ {
+		after := schedule.Next(next)
+		if after.IsZero() {
+			break
+		}
+		if d := after.Sub(next); shortest == 0 || d < shortest {
+			shortest = d
+		}
+		next = after
+	}
+
+	return shortest, nil
+}
+
+// scheduledCheck is a check that runs on a schedule of its own. owns tells if an alert, by its
+// key, comes from the check. A docker, disk or load check isn't configured without the
+// containers or the warning level to check, and then needs no schedule.
+type scheduledCheck struct {
+	name       string
+	schedule   checkSchedule
+	owns       func(key string) bool
+	run        func(config config) []verificationError
+	configured bool
+}
+
+// makeScheduledChecks returns the docker, disk and load checks, and each elk, loki, log file
+// and journal check on their own
+func makeScheduledChecks(cfg config) []scheduledCheck {
+	checks := []scheduledCheck{
+		{"docker", cfg.Schedules["docker"], ownsType("docker"), doDockerVerifications, len(cfg.DockerContainers) > 0},
+		{"disk", cfg.Schedules["disk"], ownsType("disk"), doDiskVerifications, cfg.DiskUsagePercentWarning > 0},
+		{"load", cfg.Schedules["load"], ownsType("load"), doLoadVerifications, cfg.UptimeLoad5MinutesWarning > 0},
+	}
+
+	for _, c := range cfg.ElkConfiguration {
+		c := c
+		checks = append(checks, scheduledCheck{c.checkKey(c.check()), c.checkSchedule, ownsKey(c.checkKey(c.check())), func(config config) []verificationError {
+			config.ElkConfiguration = []elkConfiguration{c}
+			return doElkVerifications(config)
+		}, true})
+	}
+	for _, c := range cfg.LokiConfiguration {
+		c := c
+		checks = append(checks, scheduledCheck{c.checkKey(c.check()), c.checkSchedule, ownsKey(c.checkKey(c.check())), func(config config) []verificationError {
+			config.LokiConfiguration = []lokiConfiguration{c}
+			return doLokiVerifications(config)
+		}, true})
+	}
+	for _, c := range cfg.LogFiles {
+		c := c
+		checks = append(checks, scheduledCheck{c.checkKey(c.check()), c.checkSchedule, ownsKey(c.checkKey(c.check()), logFileOffsetsCheck), func(config config) []verificationError {
+			config.LogFiles = []logFileConfiguration{c}
+			return doLogFileVerifications(config)
+		}, true})
+	}
+	for _, c := range cfg.Journal {
+		c := c
+		checks = append(checks, scheduledCheck{c.checkKey(c.check()), c.checkSchedule, ownsKey(c.checkKey(c.check())), func(config config) []verificationError {
+			config.Journal = []journalConfiguration{c}
+			return doJournalVerifications(config)
+		}, true})
+	}
+
+	return checks
+}
+
+// ownsType owns the alerts of a type of check, e.g. docker and docker:nginx
+func ownsType(checkType string) func(string) bool {
+	return func(key string) bool {
+		t, _ := splitCheck(key)
+		return t == checkType
+	}
+}
+
+func ownsKey(keys ...string) func(string) bool {
+	return func(key string) bool {
+		for _, k := range keys {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// scopeOf tells if an alert comes from any of the checks
+func scopeOf(checks []scheduledCheck) func(string) bool {
+	return func(key string) bool {
+		for _, c := range checks {
+			if c.owns(key) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// runScope tells if an alert is to be closed by a run of the checks when they don't fail: the
+// alerts of the checks, and those of the checks no longer in the configuration, as nothing else
+// is left to close them
+func runScope(cfg config, checks []scheduledCheck) func(string) bool {
+	ran := scopeOf(checks)
+	configured := scopeOf(makeScheduledChecks(cfg))
+	return func(key string) bool {
+		return ran(key) || !configured(key)
+	}
+}
+
+func validateSchedules(config config) error {
+	for name := range config.Schedules {
+		if name != "docker" && name != "disk" && name != "load" {
+			return fmt.Errorf("schedules has unknown check '%s', expected docker, disk or load", name)
+		}
+	}
+
+	for _, c := range makeScheduledChecks(config) {
+		err := validateCheckSchedule(c.schedule, config.CronSchedule)
+		if err != nil {
+			return fmt.Errorf("check '%s' has an %s", c.name, fmt.Sprint(err))
+		}
+	}
+
+	return nil
+}
+
+// allChecksScheduled tells if every configured check has a schedule of its own
+func allChecksScheduled(config config) bool {
+	for _, c := range makeScheduledChecks(config) {
+		if c.configured && c.schedule.Schedule == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// scheduledJob is a monitorJob and when to run it
+type scheduledJob struct {
+	spec string
+	monitorJob
+}
+
+// makeMonitorJobs groups the checks by schedule, the checks sharing a schedule being run and
+// notified together
+func makeMonitorJobs(config *config) []scheduledJob {
+	var jobs []scheduledJob
+
+	for _, c := range makeScheduledChecks(*config) {
+		spec := c.schedule.spec(config.CronSchedule)
+		if spec == "" {
+			continue
+		}
+
+		found := false
+		for i := range jobs {
+			if jobs[i].spec == spec && jobs[i].jitter == c.schedule.jitter() {
+				jobs[i].checks = append(jobs[i].checks, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			jobs = append(jobs, scheduledJob{spec, monitorJob{config, []scheduledCheck{c}, c.schedule.jitter()}})
+		}
+	}
+
+	return jobs
+}
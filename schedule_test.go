@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSchedule(t *testing.T) {
+	assert := assert.New(t)
+
+	global := "0 */10 * * * *"
+	assert.Equal(global, checkSchedule{}.spec(&global))
+	assert.Equal("", checkSchedule{}.spec(nil))
+	assert.Equal("@every 1m", checkSchedule{Schedule: "1m"}.spec(&global))
+	assert.Equal("0 0 6 * * *", checkSchedule{Schedule: "0 0 6 * * *"}.spec(&global))
+	assert.Equal(30*time.Second, checkSchedule{Jitter: "30s"}.jitter())
+
+	assert.Nil(validateCheckSchedule(checkSchedule{Schedule: "5m", Jitter: "30s"}, nil))
+	assert.Nil(validateCheckSchedule(checkSchedule{Schedule: "@daily"}, nil))
+	assert.NotNil(validateCheckSchedule(checkSchedule{Schedule: "often"}, nil))
+	assert.NotNil(validateCheckSchedule(checkSchedule{Schedule: "5m", Jitter: "a bit"}, nil))
+	assert.NotNil(validateCheckSchedule(checkSchedule{Schedule: "5m", Jitter: "-30s"}, nil), "negative jitter")
+
+	// runs may not overlap
+	assert.NotNil(validateCheckSchedule(checkSchedule{Schedule: "5m", Jitter: "5m"}, nil))
+	assert.NotNil(validateCheckSchedule(checkSchedule{Jitter: "15m"}, &global), "jitter on cron_schedule")
+	assert.Nil(validateCheckSchedule(checkSchedule{Jitter: "5m"}, &global))
+	assert.NotNil(validateCheckSchedule(checkSchedule{Schedule: "0 0 6,7 * * *", Jitter: "2h"}, nil), "the shortest time between runs")
+	assert.Nil(validateCheckSchedule(checkSchedule{Schedule: "0 0 6,7 * * *", Jitter: "30m"}, nil))
+}
+
+func TestMakeMonitorJobs(t *testing.T) {
+	assert := assert.New(t)
+
+	var c config
+	err := json.Unmarshal([]byte(`{
+  "cron_schedule": "0 */5 * * * *",
+  "schedules": {"load": {"schedule": "1m"}},
+  "elk": [
+    {"notification_message": "Errors", "query": "ERROR", "matchesEquals": 0},
+    {"notification_message": "Slow", "query": "slow", "matchesEquals": 0, "schedule": "1m"},
+    {"notification_message": "Daily", "query": "daily", "matchesAtLeast": 1, "schedule": "0 0 6 * * *", "jitter": "10m"}
+  ]
+}`), &c)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Nil(validateSchedules(c))
+
+	jobs := makeMonitorJobs(&c)
+	assert.Equal(3, len(jobs))
+	names := func(j scheduledJob) []string {
+		var n []string
+		for _, c := range j.checks {
+			n = append(n, c.name)
+		}
+		return n
+	}
+	assert.Equal("0 */5 * * * *", jobs[0].spec)
+	assert.Equal([]string{"docker", "disk", "elk:Errors"}, names(jobs[0]))
+	assert.Equal("@every 1m", jobs[1].spec)
+	assert.Equal([]string{"load", "elk:Slow"}, names(jobs[1]))
+	assert.Equal("0 0 6 * * *", jobs[2].spec)
+	assert.Equal(10*time.Minute, jobs[2].jitter)
+
+	// the alerts a job owns
+	scope := scopeOf(jobs[0].checks)
+	assert.True(scope("docker:nginx"))
+	assert.True(scope("disk"))
+	assert.True(scope("elk:Errors"))
+	assert.False(scope("elk:Slow"))
+	assert.False(scope("load"))
+
+	assert.False(allChecksScheduled(c))
+	c.ElkConfiguration = c.ElkConfiguration[1:]
+	assert.True(allChecksScheduled(c), "docker, disk and load aren't configured")
+	c.DockerContainers = []string{"nginx"}
+	c.DiskUsagePercentWarning = 90
+	c.UptimeLoad5MinutesWarning = 4
+	assert.False(allChecksScheduled(c))
+	c.Schedules = map[string]checkSchedule{"docker": {Schedule: "1m"}, "disk": {Schedule: "1h"}, "load": {Schedule: "1m"}}
+	assert.True(allChecksScheduled(c))
+
+	c.Schedules = map[string]checkSchedule{"elk": {Schedule: "1m"}}
+	assert.NotNil(validateSchedules(c), "only the built in checks")
+	c.Schedules = map[string]checkSchedule{"load": {Schedule: "every minute"}}
+	assert.NotNil(validateSchedules(c))
+}
+
+func TestUpdateScope(t *testing.T) {
+	assert := assert.New(t)
+
+	t1 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	state := newAlertState()
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Load average verification error", message: "Load average is 5.2\n", severity: severityWarning, check: "load"},
+	}
+	state.update(errors, t1, nil)
+
+	// only the load check ran, the docker alert stays open
+	recovered, _ := state.update(nil, t1.Add(time.Minute), ownsType("load"))
+	assert.Equal(1, len(recovered))
+	assert.Equal("load", recovered[0].check)
+	assert.Equal(1, len(state.Alerts))
+
+	recovered, _ = state.update(nil, t1.Add(2*time.Minute), ownsType("docker"))
+	assert.Equal(1, len(recovered))
+	assert.Equal("docker:nginx", recovered[0].check)
+}
+
+func TestRunScopeRemovedCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	zero := 0
+	elk := func(name string) elkConfiguration {
+		var c elkConfiguration
+		c.Name = name
+		c.Query = "ERROR"
+		c.Minutes = 5
+		c.MatchesEqual = &zero
+		return c
+	}
+
+	c := config{ElkConfiguration: []elkConfiguration{elk("errors")}, UptimeLoad5MinutesWarning: 4}
+	t1 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	state := newAlertState()
+	state.update([]verificationError{{title: "errors", message: "ERROR\n", check: "elk:errors"}}, t1, nil)
+
+	// the check of the alert is still configured, a job of other checks leaves it open
+	load := []scheduledCheck{makeScheduledChecks(c)[2]}
+	assert.Equal("load", load[0].name)
+	recovered, _ := state.update(nil, t1.Add(time.Minute), runScope(c, load))
+	assert.Equal(0, len(recovered))
+
+	// renamed, the alert of the old name is closed by any run
+	c.ElkConfiguration = []elkConfiguration{elk("errors in the log")}
+	recovered, _ = state.update(nil, t1.Add(2*time.Minute), runScope(c, load))
+	assert.Equal(1, len(recovered))
+	assert.Equal("elk:errors", recovered[0].check)
+	assert.Equal(0, len(state.Alerts))
+	assert.Equal("", state.Incident)
+
+	// as is that of a removed check by a run of all checks
+	state.update([]verificationError{{title: "errors", message: "ERROR\n", check: "elk:errors in the log"}}, t1.Add(3*time.Minute), nil)
+	c.ElkConfiguration = nil
+	recovered, _ = state.update(nil, t1.Add(4*time.Minute), runScope(c, makeScheduledChecks(c)))
+	assert.Equal(1, len(recovered))
+}
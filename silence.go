@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultSilences is where the silences are kept unless configured
+const defaultSilences = "silences.json"
+
+// silence stops the errors of the checks it matches from being notified until it ends. The
+// matchers are shell patterns, e.g. "jenkins*", and an empty matcher matches everything.
+type silence struct {
+	ID string `json:"id"`
+	// Type is the kind of check, e.g. docker, disk or elk
+	Type string `json:"type"`
+	// Name is what is checked, e.g. the container or mount, or the name of an elk check
+	Name    string    `json:"name"`
+	Host    string    `json:"host"`
+	Comment string    `json:"comment"`
+	Starts  time.Time `json:"starts"`
+	Ends    time.Time `json:"ends"`
+}
+
+func (s silence) active(now time.Time) bool {
+	return !now.Before(s.Starts) && now.Before(s.Ends)
+}
+
+// matches tells if the silence covers the check on the host
+func (s silence) matches(check, host string) bool {
+	checkType, name := splitCheck(check)
+	return matchPattern(s.Type, checkType) && matchPattern(s.Name, name) && matchPattern(s.Host, host)
+}
+
+func matchPattern(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+// splitCheck splits e.g. docker:nginx into docker and nginx, checks without a type such as load
+// having the whole key as both
+func splitCheck(check string) (string, string) {
+	i := strings.Index(check, ":")
+	if i < 0 {
+		return check, check
+	}
+	return check[:i], check[i+1:]
+}
+
+func validPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+func validateSilence(s silence) error {
+	if s.Type == "" && s.Name == "" && s.Host == "" {
+		return fmt.Errorf("a silence requires at least one of type, name or host")
+	}
+	for _, p := range []string{s.Type, s.Name, s.Host} {
+		if !validPattern(p) {
+			return fmt.Errorf("invalid pattern '%s'", p)
+		}
+	}
+	if !s.Ends.After(s.Starts) {
+		return fmt.Errorf("a silence has to end after it starts")
+	}
+	return nil
+}
+
+func (c config) silencesFile() string {
+	if c.Silences != "" {
+		return c.Silences
+	}
+	return defaultSilences
+}
+
+func loadSilences(file string) ([]silence, error) {
+	var silences []silence
+
+	err := readJSONFile(file, &silences)
+	if err != nil {
+		return nil, err
+	}
+
+	return silences, nil
+}
+
+// updateSilences applies update to the silences while holding the lock of the file, dropping
+// those that have ended
+func updateSilences(config config, now time.Time, update func([]silence) ([]silence, error)) error {
+	file := config.silencesFile()
+
+	unlock, err := lockFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to lock silences: %s", fmt.Sprint(err))
+	}
+	defer unlock()
+
+	silences, err := loadSilences(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read silences: %s", fmt.Sprint(err))
+	}
+
+	silences, err = update(silences)
+	if err != nil {
+		return err
+	}
+
+	var kept []silence
+	for _, s := range silences {
+		if now.Before(s.Ends) {
+			kept = append(kept, s)
+		}
+	}
+
+	err = writeJSONFile(file, kept)
+	if err != nil {
+		return fmt.Errorf("Failed to save silences: %s", fmt.Sprint(err))
+	}
+
+	return nil
+}
+
+// addSilence saves the silence, starting now unless it has a start, and returns it with its ID
+func addSilence(config config, s silence, now time.Time) (silence, error) {
+	if s.Starts.IsZero() {
+		s.Starts = now
+	}
+	err := validateSilence(s)
+	if err != nil {
+		return s, err
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	s.ID = hex.EncodeToString(b)
+
+	err = updateSilences(config, now, func(silences []silence) ([]silence, error) {
+		return append(silences, s), nil
+	})
+	return s, err
+}
+
+// expireSilence ends the silence now
+func expireSilence(config config, id string, now time.Time) error {
+	return updateSilences(config, now, func(silences []silence) ([]silence, error) {
+		for i := range silences {
+			if silences[i].ID == id {
+				silences[i].Ends = now
+				return silences, nil
+			}
+		}
+		return nil, fmt.Errorf("No silence '%s'", id)
+	})
+}
+
+// activeSilences returns the silences in effect, ordered by when they end
+func activeSilences(config config, now time.Time) ([]silence, error) {
+	silences, err := loadSilences(config.silencesFile())
+	if err != nil {
+		return nil, err
+	}
+
+	var active []silence
+	for _, s := range silences {
+		if s.active(now) {
+			active = append(active, s)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Ends.Before(active[j].Ends) })
+
+	return active, nil
+}
+
+// silenceErrors drops the errors of the checks silenced, in a maintenance window or acknowledged,
+// which are still kept track of in the alert state. The recoveries of the alerts notified before
+// are notified regardless, for the notifiers to resolve them.
+func silenceErrors(config config, errors []verificationError, now time.Time) []verificationError {
+	return unsilenced(errors, silencer(config, now))
+}
+
+// silencer returns a function telling if a check is silenced or in a maintenance window now
+func silencer(config config, now time.Time) func(check string) bool {
+	silences, err := activeSilences(config, now)
+	if err != nil {
+		log.Printf("Failed to read silences: %s\n", fmt.Sprint(err))
+	}
+	silences = append(silences, maintenanceSilences(config, now)...)
+
+	host := hostname()
+	return func(check string) bool {
+		return silenced(silences, check, host)
+	}
+}
+
+// unsilenced returns the errors that are neither acknowledged nor of a check silenced
+func unsilenced(errors []verificationError, isSilenced func(check string) bool) []verificationError {
+	var notified []verificationError
+	for _, e := range errors {
+		if e.acknowledged || isSilenced(e.key()) {
+			continue
+		}
+		notified = append(notified, e)
+	}
+
+	return notified
+}
+
+func silenced(silences []silence, check, host string) bool {
+	for _, s := range silences {
+		if s.matches(check, host) {
+			return true
+		}
+	}
+	return false
+}
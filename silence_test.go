@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSilenceMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	s := silence{Type: "docker", Name: "jenkins*"}
+	assert.True(s.matches("docker:jenkins", "web-01"))
+	assert.True(s.matches("docker:jenkins-agent", "web-02"))
+	assert.False(s.matches("docker:nginx", "web-01"))
+	assert.False(s.matches("elk:jenkins", "web-01"))
+
+	s = silence{Host: "web-0?"}
+	assert.True(s.matches("disk:/", "web-01"))
+	assert.False(s.matches("disk:/", "db-01"))
+
+	assert.True(silence{Type: "load"}.matches("load", "web-01"), "checks without a type")
+	assert.True(silence{Name: "/var/*"}.matches("disk:/var/lib", "web-01"))
+
+	// named checks keep their type
+	var c elkConfiguration
+	c.Name = "errors"
+	c.NotificationMessage = "Errors in the logs"
+	errors := c.apply([]verificationError{{title: "Errors in the logs", message: "Expected 0 matches but was 2\n"}}, c.check())
+	assert.Equal("elk:errors", errors[0].check)
+	assert.True(silence{Type: "elk"}.matches(errors[0].key(), "web-01"))
+	assert.True(silence{Type: "elk", Name: "errors"}.matches(errors[0].key(), "web-01"))
+}
+
+func TestSilences(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{Silences: filepath.Join(dir, "silences.json"), AlertState: filepath.Join(dir, "alert_state.json")}
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err = addSilence(c, silence{Ends: now.Add(time.Hour)}, now)
+	assert.NotNil(err, "no matchers")
+	_, err = addSilence(c, silence{Type: "docker", Ends: now.Add(-time.Hour)}, now)
+	assert.NotNil(err, "ends before it starts")
+	_, err = addSilence(c, silence{Name: "[", Ends: now.Add(time.Hour)}, now)
+	assert.NotNil(err, "invalid pattern")
+
+	jenkins, err := addSilence(c, silence{Type: "docker", Name: "jenkins", Comment: "upgrading", Ends: now.Add(2 * time.Hour)}, now)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(16, len(jenkins.ID))
+	assert.Equal(now, jenkins.Starts)
+	disk, err := addSilence(c, silence{Type: "disk", Ends: now.Add(time.Hour)}, now)
+	assert.Nil(err, fmt.Sprint(err))
+
+	silences, err := activeSilences(c, now)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal([]silence{disk, jenkins}, silences)
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'jenkins' is not running\n", severity: severityCritical, check: "docker:jenkins"},
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+		{title: "Load average verification error", message: "Load average is 5.2\n", severity: severityWarning, check: "load", acknowledged: true},
+	}
+	assert.Equal(errors[1:2], silenceErrors(c, errors, now))
+	assert.Equal(errors[:3], silenceErrors(c, errors, now.Add(3*time.Hour)), "the silences have ended")
+
+	err = expireSilence(c, disk.ID, now.Add(time.Minute))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.NotNil(expireSilence(c, disk.ID, now.Add(time.Minute)), "expired silences are dropped")
+	silences, err = activeSilences(c, now.Add(time.Minute))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal([]silence{jenkins}, silences)
+}
+
+func TestRunCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{Silences: filepath.Join(dir, "silences.json"), AlertState: filepath.Join(dir, "alert_state.json")}
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var b bytes.Buffer
+	err = runCommand(c, []string{"silence", "add", "-type", "docker", "-name", "jenkins", "-for", "2h", "-comment", "upgrading"}, now, &b)
+	assert.Nil(err, fmt.Sprint(err))
+	id := strings.TrimSpace(b.String())
+	assert.Equal(16, len(id))
+
+	b.Reset()
+	err = runCommand(c, []string{"silence", "list"}, now, &b)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("ID                TYPE    NAME     HOST  ENDS              COMMENT\n"+
+		id+"  docker  jenkins  *     2018-03-01 14:00  upgrading\n", b.String())
+
+	err = runCommand(c, []string{"silence", "expire", id}, now, &b)
+	assert.Nil(err, fmt.Sprint(err))
+	silences, err := activeSilences(c, now)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(0, len(silences))
+
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+	updateAlerts(c, errors, now, nil)
+	err = runCommand(c, []string{"ack", "docker:nginx"}, now, &b)
+	assert.Nil(err, fmt.Sprint(err))
+	state, err := loadAlertState(c.AlertState)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.True(state.Alerts["docker:nginx"].Acknowledged)
+
+	assert.NotNil(runCommand(c, []string{"ack"}, now, &b))
+	assert.NotNil(runCommand(c, []string{"silence", "mute"}, now, &b))
+	assert.NotNil(runCommand(c, []string{"silence", "add", "-for", "forever", "-type", "docker"}, now, &b))
+	assert.NotNil(runCommand(c, []string{"unsilence"}, now, &b))
+}
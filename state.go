@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// defaultAlertState is where the open alerts are kept between runs unless configured
+const defaultAlertState = "alert_state.json"
+
+// openAlert is a check that failed the latest run
+type openAlert struct {
+	Title     string    `json:"title"`
+	Message   string    `json:"message"`
+	Severity  string    `json:"severity"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Failures is the number of runs the check has failed
+	Failures int `json:"failures"`
+	// Acknowledged stops the alert from being escalated further
+	Acknowledged bool `json:"acknowledged,omitempty"`
+	// FailAfter and RecoverAfter are the thresholds of the check, and Passes the number of runs
+	// in a row it has passed since it last failed
+	FailAfter    int `json:"fail_after,omitempty"`
+	RecoverAfter int `json:"recover_after,omitempty"`
+	Passes       int `json:"passes,omitempty"`
+	// DependsOn are the checks the check depends on, for the checks of other jobs to be
+	// suppressed under it
+	DependsOn []string `json:"depends_on,omitempty"`
+	// Notified are the notifiers of the escalation tiers that have been told about the alert,
+	// which are the ones told about its recovery
+	Notified []string `json:"notified,omitempty"`
+	// Reported tells that the alert has been notified, its recovery isn't otherwise
+	Reported bool `json:"reported,omitempty"`
+}
+
+// firing tells if the check has failed enough runs in a row for the alert to be notified
+func (a openAlert) firing() bool {
+	return a.Failures >= a.FailAfter
+}
+
+// alertState holds the open alerts keyed by verificationError.key(), and the incident they
+// are part of
+type alertState struct {
+	Alerts map[string]openAlert `json:"alerts"`
+	// Incident identifies the stretch of time from a check starting to fail until all checks
+	// have recovered, e.g. for the mails about it to be threaded together
+	Incident string `json:"incident,omitempty"`
+	// Flaps are the state changes of the checks with flap detection
+	Flaps map[string]flapState `json:"flaps,omitempty"`
+	// Threads are the Message-IDs of the first mails of the incident that have been sent, which
+	// the later mails are replies to
+	Threads []string `json:"threads,omitempty"`
+}
+
+// incidentRef tells the notifiers which incident an error is part of
+type incidentRef struct {
+	id string
+	// opened is set if the incident started with this run
+	opened bool
+	// closed is set if all checks of the incident recovered with this run
+	closed bool
+}
+
+func newAlertState() *alertState {
+	return &alertState{Alerts: make(map[string]openAlert)}
+}
+
+// updateAlerts records the errors of a run in the alert state file and returns the errors to
+// notify and the alerts that were open but have recovered, which are also recorded in the
+// history. The errors of checks silenced, in a maintenance window or acknowledged are left out,
+// see silenceErrors, then those of checks that depend on a failing check, see
+// suppressDependents, and then those of checks that haven't failed fail_after runs in a row or
+// are flapping, and the checks that started flapping are notified instead. Only the recoveries
+// of alerts that have been notified are returned. The errors are marked with the incident they
+// are part of. Failing to read or write the state is only logged, the errors are reported
+// regardless.
+func updateAlerts(config config, errors []verificationError, now time.Time, scope func(string) bool) ([]verificationError, []verificationError) {
+	file := config.alertStateFile()
+
+	unlock, err := lockFile(file)
+	if err != nil {
+		log.Printf("Failed to lock alert state: %s\n", fmt.Sprint(err))
+	} else {
+		defer unlock()
+	}
+
+	state, err := loadAlertState(file)
+	if err != nil {
+		log.Printf("Failed to read alert state, starting over: %s\n", fmt.Sprint(err))
+		state = newAlertState()
+	}
+
+	notices := state.detectFlapping(errors, now, scope)
+	recovered, outages := state.update(errors, now, scope)
+
+	// the checks held back and those of other jobs still fail, so their dependents are held back
+	// with them
+	isSilenced := silencer(config, now)
+	var notified []verificationError
+	for _, e := range suppressDependents(unsilenced(errors, isSilenced), failingAlerts(state.Alerts, isSilenced)) {
+		if !e.pending {
+			notified = append(notified, e)
+			a := state.Alerts[e.key()]
+			a.Reported = true
+			state.Alerts[e.key()] = a
+		}
+	}
+
+	err = writeJSONFile(file, state)
+	if err != nil {
+		log.Printf("Failed to save alert state: %s\n", fmt.Sprint(err))
+	}
+
+	err = appendHistory(config.historyFile(), outages)
+	if err != nil {
+		log.Printf("Failed to record history: %s\n", fmt.Sprint(err))
+	}
+
+	var notifiedRecovered []verificationError
+	for _, e := range recovered {
+		if e.reported && !state.Flaps[e.check].Flapping {
+			notifiedRecovered = append(notifiedRecovered, e)
+		}
+	}
+
+	return append(notified, notices...), notifiedRecovered
+}
+
+// update opens an alert for each check failing and closes the alerts of the checks in scope, all
+// checks if nil, that didn't.
+// The closed alerts are returned, ordered by check, both as errors for the notifiers and as
+// outages for the history. An incident is opened with the first alert and closed with the last.
+func (s *alertState) update(errors []verificationError, now time.Time, scope func(string) bool) ([]verificationError, []historyRecord) {
+	ref := incidentRef{}
+	if len(s.Alerts) == 0 && len(errors) > 0 {
+		s.Incident = strconv.FormatInt(now.UnixNano(), 10)
+		s.Threads = nil
+		ref.opened = true
+	}
+	ref.id = s.Incident
+
+	failing := make(map[string]bool)
+
+	for i, e := range errors {
+		k := e.key()
+		a, open := s.Alerts[k]
+
+		if failing[k] {
+			// another error of the same check, it's the first that describes the alert
+			if e.severity == severityCritical {
+				a.Severity = severityCritical
+			}
+		} else {
+			if !open {
+				a.FirstSeen = now
+			}
+			a.Title = e.title
+			a.Message = e.message
+			a.Severity = e.severity
+			a.LastSeen = now
+			a.Failures++
+			a.FailAfter = e.thresholds.FailAfter
+			a.RecoverAfter = e.thresholds.RecoverAfter
+			a.Passes = 0
+			a.DependsOn = e.dependsOn
+		}
+
+		s.Alerts[k] = a
+		failing[k] = true
+		errors[i].incident = ref
+		errors[i].since = a.FirstSeen
+		errors[i].acknowledged = a.Acknowledged
+		errors[i].pending = errors[i].pending || !a.firing()
+	}
+
+	var recovered []verificationError
+	var outages []historyRecord
+	for k, a := range s.Alerts {
+		if failing[k] || (scope != nil && !scope(k)) {
+			continue
+		}
+		if !a.firing() {
+			// it never failed long enough to be notified
+			delete(s.Alerts, k)
+			continue
+		}
+		a.Passes++
+		if a.Passes < a.RecoverAfter {
+			s.Alerts[k] = a
+			continue
+		}
+		recovered = append(recovered, verificationError{title: a.Title, message: a.Message, severity: a.Severity, check: k, since: a.FirstSeen, acknowledged: a.Acknowledged, notified: a.Notified, reported: a.Reported})
+		outages = append(outages, historyRecord{Check: k, Title: a.Title, Severity: a.Severity, Started: a.FirstSeen, Ended: now, Failures: a.Failures})
+		delete(s.Alerts, k)
+	}
+	sort.Slice(recovered, func(i, j int) bool { return recovered[i].check < recovered[j].check })
+	sort.Slice(outages, func(i, j int) bool { return outages[i].Check < outages[j].Check })
+
+	if len(s.Alerts) == 0 {
+		ref.closed = len(recovered) > 0
+		s.Incident = ""
+	}
+	for i := range recovered {
+		recovered[i].incident = ref
+	}
+
+	return recovered, outages
+}
+
+// acknowledgeAlert marks the open alert of the check as acknowledged
+func acknowledgeAlert(config config, check string) error {
+	file := config.alertStateFile()
+
+	unlock, err := lockFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to lock alert state: %s", fmt.Sprint(err))
+	}
+	defer unlock()
+
+	state, err := loadAlertState(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read alert state: %s", fmt.Sprint(err))
+	}
+
+	a, ok := state.Alerts[check]
+	if !ok {
+		return fmt.Errorf("No open alert for '%s'", check)
+	}
+	a.Acknowledged = true
+	state.Alerts[check] = a
+
+	err = writeJSONFile(file, state)
+	if err != nil {
+		return fmt.Errorf("Failed to save alert state: %s", fmt.Sprint(err))
+	}
+
+	return nil
+}
+
+// recordNotified records that the notifier of an escalation tier has been told about the open
+// alerts of the errors
+func recordNotified(file string, name string, errors []verificationError) error {
+	unlock, err := lockFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to lock alert state: %s", fmt.Sprint(err))
+	}
+	defer unlock()
+
+	state, err := loadAlertState(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read alert state: %s", fmt.Sprint(err))
+	}
+
+	for _, e := range errors {
+		a, ok := state.Alerts[e.key()]
+		if !ok || containsString(a.Notified, name) {
+			continue
+		}
+		a.Notified = append(a.Notified, name)
+		state.Alerts[e.key()] = a
+	}
+
+	err = writeJSONFile(file, state)
+	if err != nil {
+		return fmt.Errorf("Failed to save alert state: %s", fmt.Sprint(err))
+	}
+
+	return nil
+}
+
+func (c config) alertStateFile() string {
+	if c.AlertState != "" {
+		return c.AlertState
+	}
+	return defaultAlertState
+}
+
+func loadAlertState(file string) (*alertState, error) {
+	state := newAlertState()
+
+	err := readJSONFile(file, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Alerts == nil {
+		state.Alerts = make(map[string]openAlert)
+	}
+
+	return state, nil
+}
+
+// readJSONFile unmarshals the file into v, leaving v as it is if there is no such file
+func readJSONFile(file string, v interface{}) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile writes v to a temporary file that is renamed over the old one so a crash never
+// leaves a half written file behind
+func writeJSONFile(file string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0640)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// lockFile takes an exclusive lock on file, for the daemon and the command line not to
+// overwrite each other's changes. The lock is held on a file of its own since the file itself
+// is replaced when written.
+func lockFile(file string) (func(), error) {
+	f, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
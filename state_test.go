@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertStateUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	t1 := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(5 * time.Minute)
+	t3 := t2.Add(5 * time.Minute)
+
+	incident := "1519905600000000000"
+
+	state := newAlertState()
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+		{title: "Log file verification error", message: "Failed to save log file offsets\n", severity: severityWarning},
+	}
+	recovered, _ := state.update(errors, t1, nil)
+	assert.Equal(0, len(recovered))
+	assert.Equal(3, len(state.Alerts))
+	assert.Equal(t1, state.Alerts["docker:nginx"].FirstSeen)
+	assert.Equal("Disk usage of / at 92 percent\n", state.Alerts["disk:/"].Message)
+	assert.Equal(severityWarning, state.Alerts["Log file verification error"].Severity, "errors without check are keyed by title")
+	assert.Equal(incident, state.Incident)
+	assert.Equal(incidentRef{id: incident, opened: true}, errors[0].incident)
+
+	// the same check failing twice in a run is one alert described by the first error
+	errors = []verificationError{
+		{title: "Disk usage verification error", message: "Disk usage of / at 95 percent\n", severity: severityWarning, check: "disk:/"},
+		{title: "Disk usage verification error", message: "strconv.Atoi: parsing \"-\"", severity: severityCritical, check: "disk:/"},
+	}
+	recovered, _ = state.update(errors, t2, nil)
+	assert.Equal([]verificationError{
+		{title: "Log file verification error", message: "Failed to save log file offsets\n", severity: severityWarning, check: "Log file verification error", incident: incidentRef{id: incident}, since: t1},
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx", incident: incidentRef{id: incident}, since: t1},
+	}, recovered)
+	assert.Equal(incidentRef{id: incident}, errors[1].incident, "the incident goes on")
+	assert.Equal(1, len(state.Alerts))
+	assert.Equal(openAlert{
+		Title:     "Disk usage verification error",
+		Message:   "Disk usage of / at 95 percent\n",
+		Severity:  severityCritical,
+		FirstSeen: t1,
+		LastSeen:  t2,
+		Failures:  2,
+	}, state.Alerts["disk:/"])
+
+	recovered, outages := state.update(nil, t3, nil)
+	assert.Equal(1, len(recovered))
+	assert.Equal("disk:/", recovered[0].check)
+	assert.Equal(incidentRef{id: incident, closed: true}, recovered[0].incident)
+	assert.Equal([]historyRecord{{Check: "disk:/", Title: "Disk usage verification error", Severity: severityCritical, Started: t1, Ended: t3, Failures: 2}}, outages)
+	assert.Equal(0, len(state.Alerts))
+	assert.Equal("", state.Incident)
+
+	// the next failure is a new incident
+	errors = []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+	state.update(errors, t3.Add(time.Minute), nil)
+	assert.True(errors[0].incident.opened)
+	assert.NotEqual(incident, errors[0].incident.id)
+}
+
+func TestUpdateAlerts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{AlertState: filepath.Join(dir, "alert_state.json")}
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+
+	notified, recovered := updateAlerts(c, errors, time.Now(), nil)
+	assert.Equal(errors, notified)
+	assert.Equal(0, len(recovered))
+	_, recovered = updateAlerts(c, errors, time.Now(), nil)
+	assert.Equal(0, len(recovered))
+
+	state, err := loadAlertState(c.AlertState)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(state.Alerts))
+
+	_, recovered = updateAlerts(c, nil, time.Now(), nil)
+	assert.Equal(1, len(recovered))
+	assert.Equal("docker:nginx", recovered[0].check)
+
+	// a broken file starts over
+	assert.Nil(ioutil.WriteFile(c.AlertState, []byte("{"), 0640))
+	_, recovered = updateAlerts(c, errors, time.Now(), nil)
+	assert.Equal(0, len(recovered))
+	_, recovered = updateAlerts(c, nil, time.Now(), nil)
+	assert.Equal(1, len(recovered))
+}
+
+func TestAcknowledgeAlert(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	c := config{AlertState: filepath.Join(dir, "alert_state.json")}
+	assert.NotNil(acknowledgeAlert(c, "docker:nginx"), "no open alert")
+
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+	updateAlerts(c, errors, time.Now(), nil)
+	assert.False(errors[0].acknowledged)
+
+	err = acknowledgeAlert(c, "docker:nginx")
+	assert.Nil(err, fmt.Sprint(err))
+
+	updateAlerts(c, errors, time.Now(), nil)
+	assert.True(errors[0].acknowledged)
+
+	// the acknowledgment ends with the alert
+	updateAlerts(c, nil, time.Now(), nil)
+	errors[0].acknowledged = false
+	updateAlerts(c, errors, time.Now(), nil)
+	assert.False(errors[0].acknowledged)
+}
@@ -24,7 +24,7 @@ func verifyRunningDockerContainers(output string, expectedContainers []string) [
 		i := sort.Search(len(lines),
 			func(i int) bool { return lines[i] >= name })
 		if i >= len(lines) || (i < len(lines) && lines[i] != name) {
-			e := verificationError{title: "Docker verification error", message: fmt.Sprintf("Docker container '%s' is not running\n", name)}
+			e := verificationError{title: "Docker verification error", message: fmt.Sprintf("Docker container '%s' is not running\n", name), check: "docker:" + name}
 			errors = append(errors, e)
 		}
 	}
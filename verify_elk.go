@@ -6,19 +6,124 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
 )
 
 type elkConfiguration struct {
-	Host                string `json:"host"`
-	Port                string `json:"port"`
-	Query               string `json:"query"`
-	MatchesEqual        *int   `json:"matchesEquals"`
-	MatchesAtLeast      *int   `json:"matchesAtLeast"`
-	Minutes             int    `json:"minutes"`
-	NotificationMessage string `json:"notification_message"`
+	checkOptions
+	matchAssertion
+	Host                string          `json:"host"`
+	Port                string          `json:"port"`
+	Query               string          `json:"query"`
+	Aggregation         *elkAggregation `json:"aggregation"`
+	Baseline            *elkBaseline    `json:"baseline"`
+	Minutes             int             `json:"minutes"`
+	NotificationMessage string          `json:"notification_message"`
+	// HitFields maps names usable in HitTemplate to fields in the hit source, e.g.
+	// {"DockerName": "container.name"}. The mapping is merged with defaultElkHitFields.
+	HitFields map[string]string `json:"hit_fields"`
+	// HitTemplate is a text/template used to render each hit in the alert, e.g.
+	// "{{.Timestamp}} {{.Level}} {{.Message}}". Defaults to defaultElkHitTemplate.
+	HitTemplate string `json:"hit_template"`
+}
+
+// defaultElkHitFields are the fields extracted from logstash documents created by the
+// docker logging setup ismonitor was originally written for
+var defaultElkHitFields = map[string]string{
+	"Timestamp":  "@timestamp",
+	"DockerName": "docker.name",
+	"Message":    "message",
+}
+
+const defaultElkHitTemplate = "{{.Timestamp}} {{.DockerName}} {{.Message}}"
+
+const (
+	elkAggregationTerms       = "terms"
+	elkAggregationPercentiles = "percentiles"
+)
+
+// elkAggregation is an assertion on the result of an elasticsearch aggregation over the
+// matching documents. For a terms aggregation no bucket (e.g. no docker.name) may have more
+// than Max matches. For a percentiles aggregation the Percent percentile of Field may not be
+// above Max.
+type elkAggregation struct {
+	Type    string   `json:"type"`
+	Field   string   `json:"field"`
+	Size    int      `json:"size"`
+	Percent float64  `json:"percent"`
+	Max     *float64 `json:"max"`
+}
+
+// check identifies the check in alerts unless it's given a name
+func (c elkConfiguration) check() string {
+	if c.NotificationMessage != "" {
+		return "elk:" + c.NotificationMessage
+	}
+	return "elk:" + c.Query
+}
+
+// validateElkConfiguration verifies that exactly one assertion is configured and that it is
+// well formed
+func validateElkConfiguration(c elkConfiguration) error {
+	n := c.count()
+	if c.Aggregation != nil {
+		n++
+	}
+	if c.Baseline != nil {
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("elk query '%s' has no assertion, expected one of matchesEquals, matchesAtLeast, matchesAtMost, matchesBetween, aggregation or baseline", c.Query)
+	}
+	if n > 1 {
+		return fmt.Errorf("elk query '%s' has more than one assertion, expected only one of matchesEquals, matchesAtLeast, matchesAtMost, matchesBetween, aggregation or baseline", c.Query)
+	}
+	if c.Minutes <= 0 {
+		return fmt.Errorf("elk query '%s' has no minutes configured", c.Query)
+	}
+	if _, err := newElkHitFormatter(c.HitFields, c.HitTemplate); err != nil {
+		return fmt.Errorf("elk query '%s' has an invalid hit_template: %s", c.Query, fmt.Sprint(err))
+	}
+
+	if c.count() > 0 {
+		err := c.matchAssertion.validate(fmt.Sprintf("elk query '%s'", c.Query))
+		if err != nil {
+			return err
+		}
+	}
+
+	if a := c.Aggregation; a != nil {
+		if a.Field == "" {
+			return fmt.Errorf("elk query '%s' has an aggregation without field", c.Query)
+		}
+		if a.Max == nil {
+			return fmt.Errorf("elk query '%s' has an aggregation without max", c.Query)
+		}
+		switch a.Type {
+		case elkAggregationTerms:
+			if a.Percent != 0 {
+				return fmt.Errorf("elk query '%s' has percent set on a terms aggregation", c.Query)
+			}
+		case elkAggregationPercentiles:
+			if a.Percent <= 0 || a.Percent > 100 {
+				return fmt.Errorf("elk query '%s' has a percentiles aggregation with percent %v outside (0, 100]", c.Query, a.Percent)
+			}
+		default:
+			return fmt.Errorf("elk query '%s' has unknown aggregation type '%s'", c.Query, a.Type)
+		}
+	}
+
+	if c.Baseline != nil {
+		err := validateElkBaseline(*c.Baseline)
+		if err != nil {
+			return fmt.Errorf("elk query '%s' has an invalid baseline: %s", c.Query, fmt.Sprint(err))
+		}
+	}
+
+	return nil
 }
 
 type elkURLTemplateData struct {
@@ -28,15 +133,16 @@ type elkURLTemplateData struct {
 }
 
 type elkBodyTemplateData struct {
-	Query   string
-	Minutes string
+	Query        string
+	Minutes      string
+	Aggregations string
 }
 
 func doElkVerifications(config config) []verificationError {
 	var errors []verificationError
 
 	for _, c := range config.ElkConfiguration {
-		errors = append(errors, doElkVerification(c)...)
+		errors = append(errors, c.apply(doElkVerification(c), c.check())...)
 	}
 
 	return errors
@@ -45,6 +151,10 @@ func doElkVerifications(config config) []verificationError {
 func doElkVerification(config elkConfiguration) []verificationError {
 	var errors []verificationError
 
+	if config.Baseline != nil {
+		return doElkBaselineVerification(config, time.Now().UTC())
+	}
+
 	// if multiple indexes that will result in multiple calls to logstash
 	// i.e. the results might be a combination of a query against the pre-midnight index and the
 	// post-midnight index (as logstash does index rotation at midnight utc)
@@ -56,45 +166,100 @@ func doElkVerification(config elkConfiguration) []verificationError {
 		return errors
 	}
 
+	formatter, err := newElkHitFormatter(config.HitFields, config.HitTemplate)
+	if err != nil {
+		e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to parse hit template: %s\n", fmt.Sprint(err))}
+		errors = append(errors, e)
+		return errors
+	}
+
+	body, err := makeBody(config.Query, config.Minutes, config.Aggregation)
+	if err != nil {
+		e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to make elk request body: %s\n", fmt.Sprint(err))}
+		errors = append(errors, e)
+		return errors
+	}
+
+	outputs, err := elkSearch(urls, body)
+	if err != nil {
+		e := verificationError{title: "Elk verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		errors = append(errors, e)
+		return errors
+	}
+
+	switch {
+	case config.Aggregation != nil:
+		e := verifyElkAggregation(outputs, *config.Aggregation, config.NotificationMessage)
+		errors = append(errors, e...)
+	case config.MatchesEqual != nil:
+		e := verifyElkExpectedNoOfMatches(outputs, *config.MatchesEqual, config.NotificationMessage, formatter)
+		errors = append(errors, e...)
+	case config.MatchesAtLeast != nil:
+		e := verifyElkAtLeastNoOfMatches(outputs, *config.MatchesAtLeast, config.NotificationMessage, formatter)
+		errors = append(errors, e...)
+	case config.MatchesAtMost != nil:
+		e := verifyElkAtMostNoOfMatches(outputs, *config.MatchesAtMost, config.NotificationMessage, formatter)
+		errors = append(errors, e...)
+	case config.MatchesBetween != nil:
+		e := verifyElkNoOfMatchesBetween(outputs, *config.MatchesBetween, config.NotificationMessage, formatter)
+		errors = append(errors, e...)
+	default:
+		e := verificationError{title: config.NotificationMessage, message: "No assertion configured\n"}
+		errors = append(errors, e)
+	}
+
+	return errors
+}
+
+// elkSearch posts the body to each of the urls and returns the responses. An index that doesn't
+// exist, e.g. the index of the day just after midnight before anything is logged, has no
+// matches and gives no response.
+func elkSearch(urls []string, body string) ([]string, error) {
 	var outputs []string
 	for _, url := range urls {
-		body, err := makeBody(config.Query, config.Minutes)
-		if err != nil {
-			e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to make elk request body: %s\n", fmt.Sprint(err))}
-			errors = append(errors, e)
-			return errors
-		}
-
 		resp, err := http.Post(url, "application/json", strings.NewReader(body))
 		if err != nil {
-			e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to make elk request: %s\n", fmt.Sprint(err))}
-			errors = append(errors, e)
-			return errors
+			return nil, fmt.Errorf("Failed to make elk request: %s", fmt.Sprint(err))
 		}
-		defer resp.Body.Close()
 		res, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
-			e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to read response from elk: %s\n", fmt.Sprint(err))}
-			errors = append(errors, e)
-			return errors
+			return nil, fmt.Errorf("Failed to read response from elk: %s", fmt.Sprint(err))
+		}
+		if resp.StatusCode == http.StatusNotFound && elkIndexNotFound(res) {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Elk request to %s failed with status %d: %s", url, resp.StatusCode, string(res))
 		}
 
 		outputs = append(outputs, string(res))
 	}
 
-	if config.MatchesEqual != nil {
-		e := verifyElkExpectedNoOfMatches(outputs, *config.MatchesEqual, config.NotificationMessage)
-		errors = append(errors, e...)
-	} else {
-		e := verifyElkAtLeastNoOfMatches(outputs, *config.MatchesAtLeast, config.NotificationMessage)
-		errors = append(errors, e...)
-	}
+	return outputs, nil
+}
 
-	return errors
+// elkIndexNotFound tells if the error response is about a missing index, as told by
+// elasticsearch 5 and later or by earlier versions
+func elkIndexNotFound(res []byte) bool {
+	return bytes.Contains(res, []byte("index_not_found_exception")) || bytes.Contains(res, []byte("IndexMissingException"))
 }
 
 type ElkResult struct {
-	Results ElkHits `json:"hits"`
+	Results      ElkHits                         `json:"hits"`
+	Aggregations map[string]ElkAggregationResult `json:"aggregations"`
+}
+
+// ElkAggregationResult holds the result of either a terms aggregation (Buckets) or a
+// percentiles aggregation (Values)
+type ElkAggregationResult struct {
+	Buckets []ElkBucket         `json:"buckets"`
+	Values  map[string]*float64 `json:"values"`
+}
+
+type ElkBucket struct {
+	Key      interface{} `json:"key"`
+	DocCount int         `json:"doc_count"`
 }
 
 type ElkHits struct {
@@ -106,75 +271,211 @@ type ElkHit struct {
 	Source ElkHitSource `json:"_source"`
 }
 
-type ElkHitSource struct {
-	Message    string `json:"message"`
-	DockerName string `json:"docker.name"`
-	Timestamp  string `json:"@timestamp"`
+type ElkHitSource map[string]interface{}
+
+// field returns the value at path in the hit source as a string. The path is first looked up
+// as a literal key, as logstash stores e.g. "docker.name" flat, and then as a dotted path into
+// nested objects, as Filebeat stores e.g. container.name as {"container": {"name": ...}}.
+// Missing fields are returned as the empty string.
+func (s ElkHitSource) field(path string) string {
+	v, ok := lookupElkField(s, path)
+	if !ok || v == nil {
+		return ""
+	}
+
+	switch value := v.(type) {
+	case string:
+		return value
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(value)
+	}
 }
 
-func verifyElkExpectedNoOfMatches(outputs []string, expectedMatches int, notificationMessage string) []verificationError {
-	var errors []verificationError
+func lookupElkField(source map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := source[path]; ok {
+		return v, true
+	}
 
+	for i := range path {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := source[path[:i]].(map[string]interface{}); ok {
+			if v, ok := lookupElkField(nested, path[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// elkHitFormatter renders a hit for inclusion in an alert message
+type elkHitFormatter struct {
+	fields   map[string]string
+	template *template.Template
+}
+
+func newElkHitFormatter(hitFields map[string]string, hitTemplate string) (*elkHitFormatter, error) {
+	fields := make(map[string]string)
+	for name, path := range defaultElkHitFields {
+		fields[name] = path
+	}
+	for name, path := range hitFields {
+		fields[name] = path
+	}
+
+	if hitTemplate == "" {
+		hitTemplate = defaultElkHitTemplate
+	}
+
+	tmpl, err := template.New("hit").Option("missingkey=zero").Parse(hitTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &elkHitFormatter{fields: fields, template: tmpl}, nil
+}
+
+func (f *elkHitFormatter) format(hit ElkHit) string {
+	data := make(map[string]string)
+	for name, path := range f.fields {
+		data[name] = hit.Source.field(path)
+	}
+
+	var b bytes.Buffer
+	err := f.template.Execute(&b, data)
+	if err != nil {
+		return fmt.Sprintf("Failed to render hit: %s", fmt.Sprint(err))
+	}
+
+	return b.String()
+}
+
+func verifyElkExpectedNoOfMatches(outputs []string, expectedMatches int, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	total, matches, err := parseElkOutputs(outputs)
+	if err != nil {
+		e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to parse json output file: %s\n", fmt.Sprint(err))}
+		return []verificationError{e}
+	}
+
+	return verifyExpectedNoOfMatches(total, matches, expectedMatches, notificationMessage, formatter)
+}
+
+func verifyElkAtLeastNoOfMatches(outputs []string, atleast int, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	total, matches, err := parseElkOutputs(outputs)
+	if err != nil {
+		e := verificationError{title: notificationMessage, message: fmt.Sprintf("Failed to parse json output file: %s\n", fmt.Sprint(err))}
+		return []verificationError{e}
+	}
+
+	return verifyAtLeastNoOfMatches(total, matches, atleast, "Elk verification error", notificationMessage, formatter)
+}
+
+func verifyElkAtMostNoOfMatches(outputs []string, atmost int, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	total, matches, err := parseElkOutputs(outputs)
+	if err != nil {
+		e := verificationError{title: notificationMessage, message: fmt.Sprintf("Failed to parse json output file: %s\n", fmt.Sprint(err))}
+		return []verificationError{e}
+	}
+
+	return verifyAtMostNoOfMatches(total, matches, atmost, notificationMessage, formatter)
+}
+
+func verifyElkNoOfMatchesBetween(outputs []string, between matchRange, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	total, matches, err := parseElkOutputs(outputs)
+	if err != nil {
+		e := verificationError{title: notificationMessage, message: fmt.Sprintf("Failed to parse json output file: %s\n", fmt.Sprint(err))}
+		return []verificationError{e}
+	}
+
+	return verifyNoOfMatchesBetween(total, matches, between, notificationMessage, formatter)
+}
+
+// parseElkOutputs parses the json outputs. Collects the matches and sums the total number of matches
+func parseElkOutputs(outputs []string) (int, []ElkHit, error) {
 	var matches []ElkHit
 	var total = 0
 
-	// parse the json outputs. Collect the matches and sum the total number of matches
 	for _, o := range outputs {
 		var res ElkResult
 		err := json.Unmarshal([]byte(o), &res)
 		if err != nil {
-			e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to parse json output file: %s\n", fmt.Sprint(err))}
-			return append(errors, e)
+			return 0, nil, err
 		}
 		matches = append(matches, res.Results.Hits...)
 		total += res.Results.Total
 	}
 
-	if total != expectedMatches {
-		if total == 0 {
-			e := verificationError{title: notificationMessage, message: fmt.Sprintf("Expected %d matches but was 0\n", expectedMatches)}
-			errors = append(errors, e)
-		} else {
-			for _, hit := range matches {
-				//errors = append(errors, fmt.Sprintf("Expected %d matches but was %d:\n", expectedMatches, total))
-				e := verificationError{title: notificationMessage, message: fmt.Sprintf("%s %s %s\n", hit.Source.Timestamp, hit.Source.DockerName, hit.Source.Message)}
-				errors = append(errors, e)
-			}
-		}
-	}
-
-	return errors
+	return total, matches, nil
 }
 
-func verifyElkAtLeastNoOfMatches(outputs []string, atleast int, notificationMessage string) []verificationError {
+// elkAggregationName is the name the aggregation is given in the request and looked up by in the response
+const elkAggregationName = "ismonitor"
+
+// verifyElkAggregation verifies the aggregation results. When the query spans two indexes the
+// terms buckets are summed, while for percentiles the highest value is used as percentiles can't
+// be combined.
+func verifyElkAggregation(outputs []string, aggregation elkAggregation, notificationMessage string) []verificationError {
 	var errors []verificationError
 
-	var matches []ElkHit
-	var total = 0
+	counts := make(map[string]int)
+	var percentile *float64
 
-	// parse the json outputs. Collect the matches and sum the total number of matches
 	for _, o := range outputs {
 		var res ElkResult
 		err := json.Unmarshal([]byte(o), &res)
 		if err != nil {
 			e := verificationError{title: notificationMessage, message: fmt.Sprintf("Failed to parse json output file: %s\n", fmt.Sprint(err))}
-			errors = append(errors, e)
-			return errors
+			return append(errors, e)
+		}
+
+		result, ok := res.Aggregations[elkAggregationName]
+		if !ok {
+			e := verificationError{title: notificationMessage, message: "No aggregation in elk response\n"}
+			return append(errors, e)
+		}
+
+		for _, b := range result.Buckets {
+			counts[fmt.Sprint(b.Key)] += b.DocCount
+		}
+		for _, v := range result.Values {
+			if v != nil && (percentile == nil || *v > *percentile) {
+				percentile = v
+			}
 		}
-		matches = append(matches, res.Results.Hits...)
-		total += res.Results.Total
 	}
 
-	if total < atleast {
-		e := verificationError{title: notificationMessage, message: fmt.Sprintf("Expected at least %d matches but was %d\n", atleast, total)}
-		errors = append(errors, e)
-		if total > 0 {
+	max := *aggregation.Max
+
+	switch aggregation.Type {
+	case elkAggregationTerms:
+		var keys []string
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if float64(counts[k]) > max {
+				e := verificationError{
+					title:   notificationMessage,
+					message: fmt.Sprintf("Expected at most %v matches for %s '%s' but was %d\n", max, aggregation.Field, k, counts[k])}
+				errors = append(errors, e)
+			}
+		}
+	case elkAggregationPercentiles:
+		if percentile != nil && *percentile > max {
 			e := verificationError{
-				title: "Elk verification error",
-				message: fmt.Sprintf("One of the matching lines: %s %s %s\n",
-					matches[0].Source.Timestamp,
-					matches[0].Source.DockerName,
-					matches[0].Source.Message)}
+				title: notificationMessage,
+				message: fmt.Sprintf("Expected percentile %v of %s to be at most %v but was %v\n",
+					aggregation.Percent, aggregation.Field, max, *percentile)}
 			errors = append(errors, e)
 		}
 	}
@@ -182,6 +483,34 @@ func verifyElkAtLeastNoOfMatches(outputs []string, atleast int, notificationMess
 	return errors
 }
 
+// makeAggregations returns the json for the aggs part of the request body
+func makeAggregations(aggregation *elkAggregation) (string, error) {
+	if aggregation == nil {
+		return "", nil
+	}
+
+	var agg map[string]interface{}
+	switch aggregation.Type {
+	case elkAggregationTerms:
+		size := aggregation.Size
+		if size <= 0 {
+			size = 100
+		}
+		agg = map[string]interface{}{"terms": map[string]interface{}{"field": aggregation.Field, "size": size}}
+	case elkAggregationPercentiles:
+		agg = map[string]interface{}{"percentiles": map[string]interface{}{"field": aggregation.Field, "percents": []float64{aggregation.Percent}}}
+	default:
+		return "", fmt.Errorf("Unknown aggregation type '%s'", aggregation.Type)
+	}
+
+	b, err := json.Marshal(map[string]interface{}{elkAggregationName: agg})
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
 func formatDateForElkIndex(time time.Time) string {
 	return time.Format("2006.01.02")
 }
@@ -223,7 +552,7 @@ func makeUrls(host string, port string, indexes []string) ([]string, error) {
 	return urls, nil
 }
 
-func makeBody(query string, minutes int) (string, error) {
+func makeBody(query string, minutes int, aggregation *elkAggregation) (string, error) {
 	const elkBodyTemplate = `{
   "query": {
     "filtered": {
@@ -259,7 +588,8 @@ func makeBody(query string, minutes int) (string, error) {
   "fielddata_fields": [
     "timestamp",
     "@timestamp"
-  ]
+  ]{{if .Aggregations}},
+  "aggs": {{.Aggregations}}{{end}}
 }'
 `
 	tmpl, err := template.New("body").Parse(elkBodyTemplate)
@@ -267,7 +597,12 @@ func makeBody(query string, minutes int) (string, error) {
 		return "", fmt.Errorf("Failed to parse elk template: %s\n", fmt.Sprint(err))
 	}
 
-	templateData := elkBodyTemplateData{template.JSEscapeString(query), fmt.Sprintf("%d", minutes)}
+	aggs, err := makeAggregations(aggregation)
+	if err != nil {
+		return "", fmt.Errorf("Failed to make elk aggregations: %s\n", fmt.Sprint(err))
+	}
+
+	templateData := elkBodyTemplateData{template.JSEscapeString(query), fmt.Sprintf("%d", minutes), aggs}
 
 	var b bytes.Buffer
 	err = tmpl.Execute(&b, templateData)
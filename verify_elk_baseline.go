@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"text/template"
+	"time"
+)
+
+const (
+	elkBaselineDay     = "day"
+	elkBaselineWeek    = "week"
+	elkBaselineAverage = "average"
+)
+
+// elkBaseline is an assertion comparing the number of matches in the current window to the
+// number of matches in the same window a day or a week ago, or to the average of the windows
+// immediately preceding the current one
+type elkBaseline struct {
+	CompareTo string `json:"compare_to"`
+	// Windows is the number of previous windows to average over when comparing to the average
+	Windows int `json:"windows"`
+	// MaxRatio alerts when the current count is more than MaxRatio times the baseline
+	MaxRatio *float64 `json:"max_ratio"`
+	// MinRatio alerts when the current count is less than MinRatio times the baseline
+	MinRatio *float64 `json:"min_ratio"`
+	// MaxDeviations alerts when the current count is more than MaxDeviations standard deviations
+	// away from the average. Only valid when comparing to the average.
+	MaxDeviations *float64 `json:"max_deviations"`
+	// MinMatches is the number of matches below which the count is never too high, for a
+	// baseline of no matches not to alert on the first
+	MinMatches int `json:"min_matches"`
+}
+
+type elkCountBodyTemplateData struct {
+	Query string
+	From  string
+	To    string
+}
+
+func validateElkBaseline(b elkBaseline) error {
+	switch b.CompareTo {
+	case elkBaselineDay, elkBaselineWeek:
+		if b.MaxDeviations != nil {
+			return fmt.Errorf("max_deviations requires compare_to '%s'", elkBaselineAverage)
+		}
+	case elkBaselineAverage:
+		if b.Windows < 2 {
+			return fmt.Errorf("windows must be at least 2 when comparing to the average")
+		}
+	default:
+		return fmt.Errorf("unknown compare_to '%s', expected one of %s, %s or %s", b.CompareTo, elkBaselineDay, elkBaselineWeek, elkBaselineAverage)
+	}
+
+	if b.MaxRatio == nil && b.MinRatio == nil && b.MaxDeviations == nil {
+		return fmt.Errorf("expected at least one of max_ratio, min_ratio or max_deviations")
+	}
+	if b.MinMatches < 0 {
+		return fmt.Errorf("min_matches %d is negative", b.MinMatches)
+	}
+	if b.MaxRatio != nil && b.MinRatio != nil && *b.MinRatio > *b.MaxRatio {
+		return fmt.Errorf("min_ratio %v is larger than max_ratio %v", *b.MinRatio, *b.MaxRatio)
+	}
+
+	return nil
+}
+
+// baselineWindowEnds returns the end of each of the windows making up the baseline for the
+// window ending at now
+func baselineWindowEnds(now time.Time, minutes int, baseline elkBaseline) []time.Time {
+	switch baseline.CompareTo {
+	case elkBaselineDay:
+		return []time.Time{now.Add(-24 * time.Hour)}
+	case elkBaselineWeek:
+		return []time.Time{now.Add(-7 * 24 * time.Hour)}
+	default:
+		var ends []time.Time
+		for i := 1; i <= baseline.Windows; i++ {
+			ends = append(ends, now.Add(time.Duration(-i*minutes)*time.Minute))
+		}
+		return ends
+	}
+}
+
+func doElkBaselineVerification(config elkConfiguration, now time.Time) []verificationError {
+	var errors []verificationError
+
+	current, err := elkCount(config, now)
+	if err != nil {
+		e := verificationError{title: "Elk verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	var previous []int
+	for _, end := range baselineWindowEnds(now, config.Minutes, *config.Baseline) {
+		count, err := elkCount(config, end)
+		if err != nil {
+			e := verificationError{title: "Elk verification error", message: fmt.Sprintf("Failed to get baseline: %s\n", fmt.Sprint(err))}
+			return append(errors, e)
+		}
+		previous = append(previous, count)
+	}
+
+	return verifyElkBaseline(current, previous, *config.Baseline, config.NotificationMessage)
+}
+
+// elkCount returns the number of matches of the query in the window of config.Minutes ending at end
+func elkCount(config elkConfiguration, end time.Time) (int, error) {
+	indexes := elkIndexToUse(end, config.Minutes)
+	urls, err := makeUrls(config.Host, config.Port, indexes)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to make urls: %s", fmt.Sprint(err))
+	}
+
+	from := end.Add(time.Duration(-config.Minutes) * time.Minute)
+	body, err := makeCountBody(config.Query, from, end)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to make elk request body: %s", fmt.Sprint(err))
+	}
+
+	outputs, err := elkSearch(urls, body)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, o := range outputs {
+		var res ElkResult
+		err := json.Unmarshal([]byte(o), &res)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to parse json output: %s", fmt.Sprint(err))
+		}
+		total += res.Results.Total
+	}
+
+	return total, nil
+}
+
+// verifyElkBaseline compares the current count to the counts of the baseline windows. The
+// standard deviation is never taken as less than 1 so a perfectly flat history doesn't alert
+// on any change at all, and a count below min_matches is never too high.
+func verifyElkBaseline(current int, previous []int, baseline elkBaseline, notificationMessage string) []verificationError {
+	var errors []verificationError
+
+	if len(previous) == 0 {
+		return errors
+	}
+
+	sum := 0.0
+	for _, p := range previous {
+		sum += float64(p)
+	}
+	mean := sum / float64(len(previous))
+
+	var description string
+	switch baseline.CompareTo {
+	case elkBaselineDay:
+		description = "the same window a day ago"
+	case elkBaselineWeek:
+		description = "the same window a week ago"
+	default:
+		description = fmt.Sprintf("the average of the previous %d windows", len(previous))
+	}
+
+	atLeastMinMatches := current >= baseline.MinMatches
+
+	if baseline.MaxRatio != nil && atLeastMinMatches && float64(current) > *baseline.MaxRatio*mean {
+		e := verificationError{
+			title: notificationMessage,
+			message: fmt.Sprintf("Expected at most %.1f matches (%v times %.1f in %s) but was %d\n",
+				*baseline.MaxRatio*mean, *baseline.MaxRatio, mean, description, current)}
+		errors = append(errors, e)
+	}
+
+	if baseline.MinRatio != nil && float64(current) < *baseline.MinRatio*mean {
+		e := verificationError{
+			title: notificationMessage,
+			message: fmt.Sprintf("Expected at least %.1f matches (%v times %.1f in %s) but was %d\n",
+				*baseline.MinRatio*mean, *baseline.MinRatio, mean, description, current)}
+		errors = append(errors, e)
+	}
+
+	if baseline.MaxDeviations != nil {
+		variance := 0.0
+		for _, p := range previous {
+			variance += (float64(p) - mean) * (float64(p) - mean)
+		}
+		stddev := math.Max(math.Sqrt(variance/float64(len(previous))), 1)
+
+		deviations := math.Abs(float64(current)-mean) / stddev
+		if deviations > *baseline.MaxDeviations && (atLeastMinMatches || float64(current) < mean) {
+			e := verificationError{
+				title: notificationMessage,
+				message: fmt.Sprintf("Expected within %v standard deviations (%.1f) of %.1f matches in %s but was %d (%.1f standard deviations)\n",
+					*baseline.MaxDeviations, stddev, mean, description, current, deviations)}
+			errors = append(errors, e)
+		}
+	}
+
+	return errors
+}
+
+func makeCountBody(query string, from time.Time, to time.Time) (string, error) {
+	const elkCountBodyTemplate = `{
+  "query": {
+    "filtered": {
+      "query": {
+        "query_string": {
+          "query": "{{.Query}}"
+        }
+      },
+      "filter": {
+        "bool": {
+          "must": [
+            {
+              "range": {
+                "@timestamp": {
+                  "gte": {{.From}},
+                  "lt": {{.To}},
+                  "format": "epoch_millis"
+                }
+              }
+            }
+          ],
+          "must_not": []
+        }
+      }
+    }
+  },
+  "size": 0
+}
+`
+	tmpl, err := template.New("countBody").Parse(elkCountBodyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse elk template: %s\n", fmt.Sprint(err))
+	}
+
+	templateData := elkCountBodyTemplateData{
+		template.JSEscapeString(query),
+		fmt.Sprintf("%d", from.UnixNano()/int64(time.Millisecond)),
+		fmt.Sprintf("%d", to.UnixNano()/int64(time.Millisecond))}
+
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, templateData)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse elk template: %s\n", fmt.Sprint(err))
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyElkBaselineRatio(t *testing.T) {
+	assert := assert.New(t)
+
+	maxRatio := 2.0
+	minRatio := 0.5
+	baseline := elkBaseline{CompareTo: "day", MaxRatio: &maxRatio, MinRatio: &minRatio}
+
+	errors := verifyElkBaseline(10, []int{10}, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkBaseline(20, []int{10}, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkBaseline(21, []int{10}, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("msg", errors[0].title)
+	assert.Equal("Expected at most 20.0 matches (2 times 10.0 in the same window a day ago) but was 21\n", errors[0].message)
+
+	errors = verifyElkBaseline(4, []int{10}, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at least 5.0 matches (0.5 times 10.0 in the same window a day ago) but was 4\n", errors[0].message)
+
+	// nothing a day ago and nothing now is fine
+	errors = verifyElkBaseline(0, []int{0}, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkBaseline(1, []int{0}, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+
+	// unless it's fewer than min_matches
+	baseline.MinMatches = 5
+	errors = verifyElkBaseline(4, []int{0}, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+	errors = verifyElkBaseline(5, []int{0}, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	errors = verifyElkBaseline(4, []int{10}, baseline, "msg")
+	assert.Equal(1, len(errors), "too few is still alerted")
+}
+
+func TestVerifyElkBaselineDeviations(t *testing.T) {
+	assert := assert.New(t)
+
+	maxDeviations := 2.0
+	baseline := elkBaseline{CompareTo: "average", Windows: 4, MaxDeviations: &maxDeviations}
+
+	// mean 10, standard deviation 2
+	previous := []int{8, 12, 8, 12}
+
+	errors := verifyElkBaseline(14, previous, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkBaseline(6, previous, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkBaseline(15, previous, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected within 2 standard deviations (2.0) of 10.0 matches in the average of the previous 4 windows but was 15 (2.5 standard deviations)\n", errors[0].message)
+
+	errors = verifyElkBaseline(5, previous, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+
+	// a flat history uses a standard deviation of 1
+	errors = verifyElkBaseline(12, []int{10, 10, 10}, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkBaseline(13, []int{10, 10, 10}, baseline, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+
+	baseline.MinMatches = 5
+	errors = verifyElkBaseline(4, []int{0, 0, 0}, baseline, "msg")
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+	errors = verifyElkBaseline(2, []int{10, 10, 10}, baseline, "msg")
+	assert.Equal(1, len(errors), "too few is still alerted")
+}
+
+func TestValidateElkBaseline(t *testing.T) {
+	assert := assert.New(t)
+
+	ratio := 2.0
+	smallRatio := 0.5
+	deviations := 3.0
+
+	assert.NotNil(validateElkBaseline(elkBaseline{CompareTo: "month", MaxRatio: &ratio}))
+	assert.NotNil(validateElkBaseline(elkBaseline{CompareTo: "day"}), "no threshold")
+	assert.Nil(validateElkBaseline(elkBaseline{CompareTo: "day", MaxRatio: &ratio}))
+	assert.Nil(validateElkBaseline(elkBaseline{CompareTo: "week", MinRatio: &smallRatio, MaxRatio: &ratio}))
+	assert.NotNil(validateElkBaseline(elkBaseline{CompareTo: "week", MinRatio: &ratio, MaxRatio: &smallRatio}), "min larger than max")
+	assert.NotNil(validateElkBaseline(elkBaseline{CompareTo: "day", MaxDeviations: &deviations}), "deviations against a single window")
+	assert.NotNil(validateElkBaseline(elkBaseline{CompareTo: "average", MaxDeviations: &deviations}), "no windows")
+	assert.Nil(validateElkBaseline(elkBaseline{CompareTo: "average", Windows: 6, MaxDeviations: &deviations}))
+	assert.NotNil(validateElkBaseline(elkBaseline{CompareTo: "day", MaxRatio: &ratio, MinMatches: -1}))
+}
+
+func TestBaselineWindowEnds(t *testing.T) {
+	assert := assert.New(t)
+
+	now, err := time.Parse("2006-01-02 15:04:05", "2016-03-07 10:00:00")
+	assert.Nil(err, fmt.Sprint(err))
+
+	ends := baselineWindowEnds(now, 5, elkBaseline{CompareTo: "day"})
+	assert.Equal([]time.Time{now.Add(-24 * time.Hour)}, ends)
+
+	ends = baselineWindowEnds(now, 5, elkBaseline{CompareTo: "week"})
+	assert.Equal([]time.Time{now.Add(-7 * 24 * time.Hour)}, ends)
+
+	ends = baselineWindowEnds(now, 5, elkBaseline{CompareTo: "average", Windows: 3})
+	assert.Equal([]time.Time{now.Add(-5 * time.Minute), now.Add(-10 * time.Minute), now.Add(-15 * time.Minute)}, ends)
+}
+
+func TestDoElkBaselineVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	now, err := time.Parse("2006-01-02 15:04:05", "2016-03-07 10:00:00")
+	assert.Nil(err, fmt.Sprint(err))
+
+	// 50 matches now and 10 matches a day ago
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		var body struct {
+			Query struct {
+				Filtered struct {
+					Filter struct {
+						Bool struct {
+							Must []struct {
+								Range struct {
+									Timestamp struct {
+										Lt int64 `json:"lt"`
+									} `json:"@timestamp"`
+								} `json:"range"`
+							} `json:"must"`
+						} `json:"bool"`
+					} `json:"filter"`
+				} `json:"filtered"`
+			} `json:"query"`
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		err := json.Unmarshal(b, &body)
+		assert.Nil(err, fmt.Sprint(err))
+
+		total := 10
+		if body.Query.Filtered.Filter.Bool.Must[0].Range.Timestamp.Lt == now.UnixNano()/int64(time.Millisecond) {
+			total = 50
+		}
+		fmt.Fprintf(w, `{"hits":{"total":%d,"hits":[]}}`, total)
+	}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.Nil(err, fmt.Sprint(err))
+
+	maxRatio := 3.0
+	var c elkConfiguration
+	c.Host = host
+	c.Port = port
+	c.Query = "message:\"Upload\""
+	c.Minutes = 5
+	c.NotificationMessage = "Unusual number of uploads"
+	c.Baseline = &elkBaseline{CompareTo: "day", MaxRatio: &maxRatio}
+
+	errors := doElkBaselineVerification(c, now)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Unusual number of uploads", errors[0].title)
+	assert.Equal("Expected at most 30.0 matches (3 times 10.0 in the same window a day ago) but was 50\n", errors[0].message)
+	assert.Equal([]string{"/logstash-2016.03.07/logs/_search", "/logstash-2016.03.06/logs/_search"}, paths)
+
+	// an index that doesn't exist has no matches
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"type":"index_not_found_exception"},"status":404}`, http.StatusNotFound)
+	})
+	errors = doElkBaselineVerification(c, now)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	// unavailable elasticsearch
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"search_phase_execution_exception"}`, http.StatusServiceUnavailable)
+	})
+	errors = doElkBaselineVerification(c, now)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Elk verification error", errors[0].title)
+}
+
+func TestMakeCountBody(t *testing.T) {
+	assert := assert.New(t)
+
+	to := time.Unix(1457344800, 0)
+	body, err := makeCountBody("message:\"ERROR\"", to.Add(-5*time.Minute), to)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Contains(body, `"query": "message:\"ERROR\""`)
+	assert.Contains(body, `"gte": 1457344500000,`)
+	assert.Contains(body, `"lt": 1457344800000,`)
+	assert.Contains(body, `"size": 0`)
+
+	var parsed map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(body), &parsed))
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -15,13 +17,16 @@ func TestVerifyElkExpectedNoOfMatches(t *testing.T) {
 	output, err := ioutil.ReadFile("test/output_elk.json")
 	assert.Nil(err, fmt.Sprint(err))
 
-	errors := verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg")
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg", formatter)
 	assert.Equal(5, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 1, "msg")
+	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 1, "msg", formatter)
 	assert.Equal(5, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 5, "msg")
+	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 5, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 }
 
@@ -31,13 +36,16 @@ func TestVerifyElkExpectedNoOfMatchesWithNoMatches(t *testing.T) {
 	output, err := ioutil.ReadFile("test/output_elk_no_matches.json")
 	assert.Nil(err, fmt.Sprint(err))
 
-	errors := verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg")
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 1, "msg")
+	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 1, "msg", formatter)
 	assert.Equal(1, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 5, "msg")
+	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 5, "msg", formatter)
 	assert.Equal(1, len(errors), fmt.Sprint(errors))
 }
 
@@ -47,19 +55,22 @@ func TestVerifyElkAtLeastNoOfMatches(t *testing.T) {
 	output, err := ioutil.ReadFile("test/output_elk.json")
 	assert.Nil(err, fmt.Sprint(err))
 
-	errors := verifyElkAtLeastNoOfMatches([]string{string(output)}, 0, "msg")
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkAtLeastNoOfMatches([]string{string(output)}, 0, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 1, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 1, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 5, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 5, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 6, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 6, "msg", formatter)
 	assert.Equal(2, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 55, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 55, "msg", formatter)
 	assert.Equal(2, len(errors), fmt.Sprint(errors))
 }
 
@@ -69,19 +80,22 @@ func TestVerifyElkAtLeastNoOfMatchesWithNoMatches(t *testing.T) {
 	output, err := ioutil.ReadFile("test/output_elk_no_matches.json")
 	assert.Nil(err, fmt.Sprint(err))
 
-	errors := verifyElkAtLeastNoOfMatches([]string{string(output)}, 0, "msg")
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkAtLeastNoOfMatches([]string{string(output)}, 0, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 1, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 1, "msg", formatter)
 	assert.Equal(1, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 5, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 5, "msg", formatter)
 	assert.Equal(1, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 6, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 6, "msg", formatter)
 	assert.Equal(1, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 55, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 55, "msg", formatter)
 	assert.Equal(1, len(errors), fmt.Sprint(errors))
 }
 
@@ -94,30 +108,215 @@ func TestVerifyElkAroundMidnight(t *testing.T) {
 	output2, err := ioutil.ReadFile("test/output_elk_after_midnight.json")
 	assert.Nil(err, fmt.Sprint(err))
 
-	errors := verifyElkExpectedNoOfMatches([]string{string(output1), string(output2)}, 0, "msg")
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkExpectedNoOfMatches([]string{string(output1), string(output2)}, 0, "msg", formatter)
 	assert.Equal(5, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkExpectedNoOfMatches([]string{string(output1), string(output2)}, 1, "msg")
+	errors = verifyElkExpectedNoOfMatches([]string{string(output1), string(output2)}, 1, "msg", formatter)
 	assert.Equal(5, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkExpectedNoOfMatches([]string{string(output1), string(output2)}, 5, "msg")
+	errors = verifyElkExpectedNoOfMatches([]string{string(output1), string(output2)}, 5, "msg", formatter)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 0, "msg", formatter)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 1, "msg", formatter)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 5, "msg", formatter)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 6, "msg", formatter)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 55, "msg", formatter)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+
+}
+
+func TestVerifyElkAtMostNoOfMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	output, err := ioutil.ReadFile("test/output_elk.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkAtMostNoOfMatches([]string{string(output)}, 5, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 0, "msg")
+	errors = verifyElkAtMostNoOfMatches([]string{string(output)}, 4, "msg", formatter)
+	assert.Equal(6, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at most 4 matches but was 5\n", errors[0].message)
+
+	errors = verifyElkAtMostNoOfMatches([]string{"not json"}, 4, "msg", formatter)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+}
+
+func TestVerifyElkNoOfMatchesBetween(t *testing.T) {
+	assert := assert.New(t)
+
+	output, err := ioutil.ReadFile("test/output_elk.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkNoOfMatchesBetween([]string{string(output)}, matchRange{Min: 1, Max: 5}, "msg", formatter)
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 1, "msg")
+	errors = verifyElkNoOfMatchesBetween([]string{string(output)}, matchRange{Min: 6, Max: 10}, "msg", formatter)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected between 6 and 10 matches but was 5\n", errors[0].message)
+
+	errors = verifyElkNoOfMatchesBetween([]string{string(output)}, matchRange{Min: 1, Max: 3}, "msg", formatter)
+	assert.Equal(6, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected between 1 and 3 matches but was 5\n", errors[0].message)
+}
+
+func TestVerifyElkTermsAggregation(t *testing.T) {
+	assert := assert.New(t)
+
+	output, err := ioutil.ReadFile("test/output_elk_terms.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	max := 10.0
+	aggregation := elkAggregation{Type: "terms", Field: "docker.name", Max: &max}
+
+	errors := verifyElkAggregation([]string{string(output)}, aggregation, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at most 10 matches for docker.name '/jenkins' but was 14\n", errors[0].message)
+
+	// buckets are summed over indexes
+	errors = verifyElkAggregation([]string{string(output), string(output)}, aggregation, "msg")
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at most 10 matches for docker.name '/jenkins' but was 28\n", errors[0].message)
+	assert.Equal("Expected at most 10 matches for docker.name '/nginx' but was 20\n", errors[1].message)
+
+	max = 14
+	errors = verifyElkAggregation([]string{string(output)}, aggregation, "msg")
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 5, "msg")
+	noMatches, err := ioutil.ReadFile("test/output_elk_no_matches.json")
+	assert.Nil(err, fmt.Sprint(err))
+	errors = verifyElkAggregation([]string{string(noMatches)}, aggregation, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("No aggregation in elk response\n", errors[0].message)
+}
+
+func TestVerifyElkPercentilesAggregation(t *testing.T) {
+	assert := assert.New(t)
+
+	output, err := ioutil.ReadFile("test/output_elk_percentiles.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	max := 500.0
+	aggregation := elkAggregation{Type: "percentiles", Field: "response_time", Percent: 95, Max: &max}
+
+	errors := verifyElkAggregation([]string{string(output)}, aggregation, "msg")
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected percentile 95 of response_time to be at most 500 but was 512.5\n", errors[0].message)
+
+	max = 600
+	errors = verifyElkAggregation([]string{string(output)}, aggregation, "msg")
 	assert.Equal(0, len(errors), fmt.Sprint(errors))
+}
+
+func TestValidateElkConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	zero := 0
+	five := 5
+	max := 500.0
+
+	var c elkConfiguration
+	c.Query = "query"
+	c.Minutes = 5
+	assert.NotNil(validateElkConfiguration(c), "no assertion")
+
+	c.MatchesEqual = &zero
+	assert.Nil(validateElkConfiguration(c))
+
+	c.HitTemplate = "{{.Message"
+	assert.NotNil(validateElkConfiguration(c), "invalid hit template")
+	c.HitTemplate = "{{.Message}}"
+	assert.Nil(validateElkConfiguration(c))
+
+	c.MatchesAtLeast = &five
+	assert.NotNil(validateElkConfiguration(c), "two assertions")
+
+	c.MatchesEqual = nil
+	c.MatchesAtLeast = nil
+	c.MatchesBetween = &matchRange{Min: 5, Max: 1}
+	assert.NotNil(validateElkConfiguration(c), "min larger than max")
+
+	c.MatchesBetween = &matchRange{Min: 1, Max: 5}
+	assert.Nil(validateElkConfiguration(c))
+
+	c.Aggregation = &elkAggregation{Type: "percentiles", Field: "response_time", Percent: 95, Max: &max}
+	assert.NotNil(validateElkConfiguration(c), "range and aggregation")
+
+	c.MatchesBetween = nil
+	assert.Nil(validateElkConfiguration(c))
+
+	c.Aggregation.Percent = 0
+	assert.NotNil(validateElkConfiguration(c), "no percent")
+
+	c.Aggregation = &elkAggregation{Type: "terms", Field: "docker.name"}
+	assert.NotNil(validateElkConfiguration(c), "no max")
+
+	c.Aggregation = &elkAggregation{Type: "histogram", Field: "docker.name", Max: &max}
+	assert.NotNil(validateElkConfiguration(c), "unknown type")
+
+	c.Aggregation = &elkAggregation{Type: "terms", Field: "docker.name", Max: &max}
+	assert.Nil(validateElkConfiguration(c))
+
+	c.Minutes = 0
+	assert.NotNil(validateElkConfiguration(c), "no minutes")
+}
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 6, "msg")
+func TestElkHitFormatter(t *testing.T) {
+	assert := assert.New(t)
+
+	output, err := ioutil.ReadFile("test/output_elk.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	formatter, err := newElkHitFormatter(nil, "")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors := verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg", formatter)
+	assert.Equal(5, len(errors), fmt.Sprint(errors))
+	assert.Equal("2015-11-16T10:53:33.088Z /foo 2015-11-16 11:53:33 ERROR foo error\n", errors[0].message)
+
+	output, err = ioutil.ReadFile("test/output_elk_filebeat.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	// default mapping doesn't find the docker name in filebeat documents
+	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg", formatter)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("2016-03-01T10:53:33.088Z  Connection refused\n", errors[0].message)
+
+	formatter, err = newElkHitFormatter(
+		map[string]string{"DockerName": "container.name", "Level": "log.level", "ResponseTime": "response_time"},
+		"{{.Timestamp}} [{{.Level}}] {{.DockerName}}: {{.Message}} ({{.ResponseTime}}ms){{.Unknown}}")
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors = verifyElkExpectedNoOfMatches([]string{string(output)}, 0, "msg", formatter)
 	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("2016-03-01T10:53:33.088Z [ERROR] jenkins: Connection refused (512ms)\n", errors[0].message)
+	assert.Equal("2016-03-01T10:53:32.972Z [WARN] nginx: Connection reset (87ms)\n", errors[1].message)
 
-	errors = verifyElkAtLeastNoOfMatches([]string{string(output1), string(output2)}, 55, "msg")
+	errors = verifyElkAtLeastNoOfMatches([]string{string(output)}, 3, "msg", formatter)
 	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("One of the matching lines: 2016-03-01T10:53:33.088Z [ERROR] jenkins: Connection refused (512ms)\n", errors[1].message)
+	assert.Equal("Elk verification error", errors[1].title)
 
+	_, err = newElkHitFormatter(nil, "{{.Timestamp")
+	assert.NotNil(err)
 }
 
 func TestFormatDateForElkIndex(t *testing.T) {
@@ -174,7 +373,7 @@ func TestMakeUrl(t *testing.T) {
 func TestMakeBody(t *testing.T) {
 	assert := assert.New(t)
 
-	body, err := makeBody("query", 60)
+	body, err := makeBody("query", 60, nil)
 	assert.Nil(err, fmt.Sprint(err))
 
 	const res = `{
@@ -218,3 +417,43 @@ func TestMakeBody(t *testing.T) {
 
 	assert.Equal(res, body)
 }
+
+func TestMakeBodyWithAggregation(t *testing.T) {
+	assert := assert.New(t)
+
+	max := 10.0
+	body, err := makeBody("query", 5, &elkAggregation{Type: "terms", Field: "docker.name", Max: &max})
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Contains(body, `  ],
+  "aggs": {"ismonitor":{"terms":{"field":"docker.name","size":100}}}
+}'`)
+
+	body, err = makeBody("query", 5, &elkAggregation{Type: "percentiles", Field: "response_time", Percent: 95, Max: &max})
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Contains(body, `"aggs": {"ismonitor":{"percentiles":{"field":"response_time","percents":[95]}}}`)
+}
+
+func TestElkSearchMissingIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/logstash-2016.03.07/logs/_search":
+			http.Error(w, `{"error":{"root_cause":[{"type":"index_not_found_exception"}],"type":"index_not_found_exception"},"status":404}`, http.StatusNotFound)
+		case "/logstash-2016.03.06/logs/_search":
+			fmt.Fprint(w, `{"hits":{"total":1,"hits":[]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// the index of the day just started doesn't exist yet
+	outputs, err := elkSearch([]string{server.URL + "/logstash-2016.03.06/logs/_search", server.URL + "/logstash-2016.03.07/logs/_search"}, "{}")
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal([]string{`{"hits":{"total":1,"hits":[]}}`}, outputs)
+
+	// other errors, also those without a body telling what is missing, are errors
+	_, err = elkSearch([]string{server.URL + "/other/_search"}, "{}")
+	assert.NotNil(err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type journalConfiguration struct {
+	checkOptions
+	matchAssertion
+	// Directory is where the journal files are, searched recursively. Defaults to /var/log/journal.
+	Directory string `json:"directory"`
+	// Units restricts the entries to the given systemd units, e.g. nginx.service
+	Units []string `json:"units"`
+	// Priority restricts the entries to the given priority or more severe, e.g. 3 for err
+	Priority *int `json:"priority"`
+	// Pattern is a regular expression the message has to match
+	Pattern             string `json:"pattern"`
+	Minutes             int    `json:"minutes"`
+	NotificationMessage string `json:"notification_message"`
+}
+
+const defaultJournalDirectory = "/var/log/journal"
+
+// maxJournalLines is the maximum number of matching entries kept to be included in the alert
+const maxJournalLines = 500
+
+// check identifies the check in alerts unless it's given a name
+func (c journalConfiguration) check() string {
+	if c.NotificationMessage != "" {
+		return "journal:" + c.NotificationMessage
+	}
+	return "journal:" + strings.Join(c.Units, ",") + " " + c.Pattern
+}
+
+func validateJournalConfiguration(c journalConfiguration) error {
+	if _, err := regexp.Compile(c.Pattern); err != nil {
+		return fmt.Errorf("journal check '%s' has an invalid pattern: %s", c.NotificationMessage, fmt.Sprint(err))
+	}
+	if c.Priority != nil && (*c.Priority < 0 || *c.Priority > 7) {
+		return fmt.Errorf("journal check '%s' has priority %d outside 0-7", c.NotificationMessage, *c.Priority)
+	}
+	if c.Minutes <= 0 {
+		return fmt.Errorf("journal check '%s' has no minutes configured", c.NotificationMessage)
+	}
+
+	return c.matchAssertion.validate(fmt.Sprintf("journal check '%s'", c.NotificationMessage))
+}
+
+func doJournalVerifications(config config) []verificationError {
+	var errors []verificationError
+
+	for _, c := range config.Journal {
+		errors = append(errors, c.apply(doJournalVerification(c, time.Now()), c.check())...)
+	}
+
+	return errors
+}
+
+func doJournalVerification(config journalConfiguration, now time.Time) []verificationError {
+	var errors []verificationError
+
+	re, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		e := verificationError{title: "Journal verification error", message: fmt.Sprintf("Failed to parse pattern: %s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	directory := config.Directory
+	if directory == "" {
+		directory = defaultJournalDirectory
+	}
+
+	files, err := journalFiles(directory)
+	if err != nil {
+		e := verificationError{title: "Journal verification error", message: fmt.Sprintf("Failed to list journal files: %s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	since := now.Add(time.Duration(-config.Minutes) * time.Minute)
+
+	var entries []journalEntry
+	for _, file := range files {
+		e, err := readJournalFile(file, since)
+		if err != nil {
+			e := verificationError{title: "Journal verification error", message: fmt.Sprintf("Failed to read journal file %s: %s\n", file, fmt.Sprint(err))}
+			errors = append(errors, e)
+			continue
+		}
+		entries = append(entries, e...)
+	}
+
+	matching := filterJournalEntries(entries, config.Units, config.Priority, re)
+
+	// newest first, as for the elk queries
+	sort.SliceStable(matching, func(i, j int) bool { return matching[i].realtime.After(matching[j].realtime) })
+
+	var matches []ElkHit
+	for _, e := range matching {
+		if len(matches) == maxJournalLines {
+			break
+		}
+		matches = append(matches, ElkHit{Source: ElkHitSource{
+			"@timestamp": e.realtime.UTC().Format(time.RFC3339Nano),
+			"unit":       e.fields["_SYSTEMD_UNIT"],
+			"priority":   e.fields["PRIORITY"],
+			"message":    e.fields["MESSAGE"],
+		}})
+	}
+
+	formatter, err := newElkHitFormatter(map[string]string{"Unit": "unit"}, "{{.Timestamp}} {{.Unit}}: {{.Message}}")
+	if err != nil {
+		e := verificationError{title: "Journal verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	return append(errors, verifyNoOfMatches(config.matchAssertion, len(matching), matches, "Journal verification error", config.NotificationMessage, formatter)...)
+}
+
+// journalFiles returns the journal files in directory and its subdirectories, which is where
+// journald puts the files of each machine id. Files journald found corrupt are named *.journal~
+// and are skipped.
+func journalFiles(directory string) ([]string, error) {
+	var files []string
+
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".journal") {
+			files = append(files, path)
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+func filterJournalEntries(entries []journalEntry, units []string, priority *int, re *regexp.Regexp) []journalEntry {
+	var matching []journalEntry
+
+	for _, e := range entries {
+		if len(units) > 0 && !containsString(units, e.fields["_SYSTEMD_UNIT"]) {
+			continue
+		}
+		if priority != nil {
+			p, err := strconv.Atoi(e.fields["PRIORITY"])
+			if err != nil || p > *priority {
+				continue
+			}
+		}
+		if !re.MatchString(e.fields["MESSAGE"]) {
+			continue
+		}
+		matching = append(matching, e)
+	}
+
+	return matching
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoJournalVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	// journald keeps the files in a directory per machine id
+	machineDir := filepath.Join(dir, "0123456789abcdef0123456789abcdef")
+	assert.Nil(os.Mkdir(machineDir, 0755))
+
+	now := time.Unix(1457344800, 0)
+	writeTestJournal(t, filepath.Join(machineDir, "system@0005a1b2c3d4e5f6-0123456789abcdef.journal"), false, []testJournalEntry{
+		{now.Add(-time.Hour), []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=3", "MESSAGE=Old error"}},
+		{now.Add(-3 * time.Minute), []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=3", "MESSAGE=Failed to bind to port 80"}},
+	})
+	writeTestJournal(t, filepath.Join(machineDir, "system.journal"), true, []testJournalEntry{
+		{now.Add(-2 * time.Minute), []string{"_SYSTEMD_UNIT=cron.service", "PRIORITY=3", "MESSAGE=Failed to run job"}},
+		{now.Add(-time.Minute), []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=6", "MESSAGE=Started nginx"}},
+		{now.Add(-30 * time.Second), []string{"_SYSTEMD_UNIT=nginx.service", "PRIORITY=2", "MESSAGE=Failed to start"}},
+	})
+	// corrupt files are renamed by journald and skipped
+	assert.Nil(ioutil.WriteFile(filepath.Join(machineDir, "system.journal~"), []byte("corrupt"), 0644))
+
+	zero := 0
+	priority := 3
+	var c journalConfiguration
+	c.Directory = dir
+	c.Units = []string{"nginx.service"}
+	c.Priority = &priority
+	c.Minutes = 5
+	c.NotificationMessage = "nginx errors the last 5 minutes"
+	c.MatchesEqual = &zero
+
+	errors := doJournalVerification(c, now)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("nginx errors the last 5 minutes", errors[0].title)
+	assert.Equal("2016-03-07T09:59:30Z nginx.service: Failed to start\n", errors[0].message)
+	assert.Equal("2016-03-07T09:57:00Z nginx.service: Failed to bind to port 80\n", errors[1].message)
+
+	c.Pattern = "bind"
+	errors = doJournalVerification(c, now)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("2016-03-07T09:57:00Z nginx.service: Failed to bind to port 80\n", errors[0].message)
+
+	// all units and priorities
+	atLeast := 5
+	c.Pattern = ""
+	c.Units = nil
+	c.Priority = nil
+	c.MatchesEqual = nil
+	c.MatchesAtLeast = &atLeast
+	errors = doJournalVerification(c, now)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at least 5 matches but was 4\n", errors[0].message)
+
+	c.Directory = filepath.Join(dir, "missing")
+	errors = doJournalVerification(c, now)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Journal verification error", errors[0].title)
+}
+
+func TestValidateJournalConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	zero := 0
+	priority := 8
+	var c journalConfiguration
+	c.Minutes = 5
+	assert.NotNil(validateJournalConfiguration(c), "no assertion")
+
+	c.MatchesEqual = &zero
+	assert.Nil(validateJournalConfiguration(c))
+
+	c.Priority = &priority
+	assert.NotNil(validateJournalConfiguration(c), "invalid priority")
+
+	c.Priority = nil
+	c.Pattern = "("
+	assert.NotNil(validateJournalConfiguration(c), "invalid pattern")
+
+	c.Pattern = ""
+	c.Minutes = 0
+	assert.NotNil(validateJournalConfiguration(c), "no minutes")
+}
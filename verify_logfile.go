@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+type logFileConfiguration struct {
+	checkOptions
+	matchAssertion
+	// Path is a glob of the files to tail, e.g. /var/log/app/*.log. To not miss lines written
+	// just before a rotation the glob should match the rotated file name as well, e.g. app.log*.
+	Path string `json:"path"`
+	// Pattern is the regular expression a line has to match to be counted
+	Pattern             string `json:"pattern"`
+	NotificationMessage string `json:"notification_message"`
+}
+
+// defaultLogFileOffsets is where the read offsets are kept between runs unless configured
+const defaultLogFileOffsets = "logfile_offsets.json"
+
+// logFileOffsetsCheck is the check of the errors reading and saving the offsets
+const logFileOffsetsCheck = "log_file"
+
+// logFileOffsetsMu serializes the log file checks reading and saving the offsets
+var logFileOffsetsMu sync.Mutex
+
+// maxLogFileLines is the maximum number of matching lines kept to be included in the alert
+const maxLogFileLines = 500
+
+// logFileOffsets holds the read offsets of the files of each log file check, keyed by
+// logFileConfiguration.key() and then by file name
+type logFileOffsets map[string]map[string]logFileOffset
+
+type logFileOffset struct {
+	Offset int64  `json:"offset"`
+	Inode  uint64 `json:"inode"`
+}
+
+func (c logFileConfiguration) key() string {
+	return c.Path + " " + c.Pattern
+}
+
+// check identifies the check in alerts unless it's given a name
+func (c logFileConfiguration) check() string {
+	if c.NotificationMessage != "" {
+		return "log_file:" + c.NotificationMessage
+	}
+	return "log_file:" + c.Path
+}
+
+func validateLogFileConfiguration(c logFileConfiguration) error {
+	if c.Path == "" {
+		return fmt.Errorf("log file check has no path")
+	}
+	if _, err := filepath.Match(c.Path, ""); err != nil {
+		return fmt.Errorf("log file check '%s' has an invalid path: %s", c.Path, fmt.Sprint(err))
+	}
+	if _, err := regexp.Compile(c.Pattern); err != nil {
+		return fmt.Errorf("log file check '%s' has an invalid pattern: %s", c.Path, fmt.Sprint(err))
+	}
+
+	return c.matchAssertion.validate(fmt.Sprintf("log file check '%s'", c.Path))
+}
+
+func doLogFileVerifications(config config) []verificationError {
+	var errors []verificationError
+
+	if len(config.LogFiles) == 0 {
+		return errors
+	}
+
+	// the checks may run at the same time on schedules of their own
+	logFileOffsetsMu.Lock()
+	defer logFileOffsetsMu.Unlock()
+
+	offsetsFile := config.LogFileOffsets
+	if offsetsFile == "" {
+		offsetsFile = defaultLogFileOffsets
+	}
+
+	offsets, err := loadLogFileOffsets(offsetsFile)
+	if err != nil {
+		e := verificationError{title: "Log file verification error", message: fmt.Sprintf("Failed to read log file offsets, starting over: %s\n", fmt.Sprint(err)), check: logFileOffsetsCheck}
+		errors = append(errors, e)
+		offsets = make(logFileOffsets)
+	}
+
+	for _, c := range config.LogFiles {
+		errors = append(errors, c.apply(doLogFileVerification(c, offsets), c.check())...)
+	}
+
+	err = saveLogFileOffsets(offsetsFile, offsets)
+	if err != nil {
+		e := verificationError{title: "Log file verification error", message: fmt.Sprintf("Failed to save log file offsets: %s\n", fmt.Sprint(err)), check: logFileOffsetsCheck}
+		errors = append(errors, e)
+	}
+
+	return errors
+}
+
+// doLogFileVerification verifies the lines written to the files since the previous run and
+// updates the offsets. The first time a check is run the files are read from their current end.
+func doLogFileVerification(config logFileConfiguration, offsets logFileOffsets) []verificationError {
+	var errors []verificationError
+
+	re, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		e := verificationError{title: "Log file verification error", message: fmt.Sprintf("Failed to parse pattern: %s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	previous, seen := offsets[config.key()]
+	total, matches, next, err := tailLogFiles(config.Path, re, previous, !seen)
+	if err != nil {
+		e := verificationError{title: "Log file verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+	offsets[config.key()] = next
+
+	// the first run only records where the files end
+	if !seen {
+		return errors
+	}
+
+	formatter, err := newElkHitFormatter(map[string]string{"Path": "path"}, "{{.Path}}: {{.Message}}")
+	if err != nil {
+		e := verificationError{title: "Log file verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	return verifyNoOfMatches(config.matchAssertion, total, matches, "Log file verification error", config.NotificationMessage, formatter)
+}
+
+// compressedLogFiles are the extensions of rotated files that can't be read as text
+var compressedLogFiles = []string{".gz", ".bz2", ".xz", ".zst", ".zip"}
+
+// compressedLogFile tells if the file is a compressed rotated file, which the glob of a log file
+// check such as app.log* also matches
+func compressedLogFile(file string) bool {
+	for _, ext := range compressedLogFiles {
+		if strings.HasSuffix(file, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// tailLogFiles reads the complete lines written to the files matching glob since the previous
+// offsets and returns the number of lines matching re, the first maxLogFileLines of them and
+// the new offsets.
+//
+// A file is recognized by its inode so that a rotated file, renamed but still matched by the
+// glob, is read from where it was left. A file that is smaller than its offset has been
+// truncated and is read from the start, as is a file not seen before. When skipExisting is set
+// the files are not read at all, only their current sizes are recorded.
+func tailLogFiles(glob string, re *regexp.Regexp, previous map[string]logFileOffset, skipExisting bool) (int, []ElkHit, map[string]logFileOffset, error) {
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("Failed to list log files: %s", fmt.Sprint(err))
+	}
+
+	byInode := make(map[uint64]logFileOffset)
+	for _, o := range previous {
+		byInode[o.Inode] = o
+	}
+
+	total := 0
+	var matches []ElkHit
+	next := make(map[string]logFileOffset)
+
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("Failed to stat log file: %s", fmt.Sprint(err))
+		}
+		if fi.IsDir() || compressedLogFile(file) {
+			continue
+		}
+		inode := fileInode(fi)
+
+		var start int64
+		if skipExisting {
+			start = fi.Size()
+		} else if o, ok := previous[file]; ok && o.Inode == inode {
+			start = o.Offset
+		} else if o, ok := byInode[inode]; ok {
+			start = o.Offset
+		}
+		if start > fi.Size() {
+			start = 0
+		}
+
+		end := start
+		if !skipExisting {
+			n, lines, read, err := readLogFile(file, start, re)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			total += n
+			end += read
+			for _, l := range lines {
+				if len(matches) < maxLogFileLines {
+					matches = append(matches, ElkHit{Source: ElkHitSource{"path": file, "message": l}})
+				}
+			}
+		}
+
+		next[file] = logFileOffset{Offset: end, Inode: inode}
+	}
+
+	return total, matches, next, nil
+}
+
+// readLogFile reads the complete lines from offset and returns the number of lines matching re,
+// the first maxLogFileLines of them and the number of bytes read. A trailing line without newline
+// is still being written and is left for the next run.
+func readLogFile(file string, offset int64, re *regexp.Regexp) (int, []string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("Failed to open log file: %s", fmt.Sprint(err))
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("Failed to seek in log file: %s", fmt.Sprint(err))
+	}
+
+	total := 0
+	var lines []string
+	var read int64
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, 0, fmt.Errorf("Failed to read log file: %s", fmt.Sprint(err))
+		}
+		read += int64(len(line))
+
+		line = strings.TrimRight(line, "\r\n")
+		if re.MatchString(line) {
+			total++
+			if len(lines) < maxLogFileLines {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	return total, lines, read, nil
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+func loadLogFileOffsets(file string) (logFileOffsets, error) {
+	offsets := make(logFileOffsets)
+
+	err := readJSONFile(file, &offsets)
+	if err != nil {
+		return nil, err
+	}
+
+	return offsets, nil
+}
+
+func saveLogFileOffsets(file string, offsets logFileOffsets) error {
+	return writeJSONFile(file, offsets)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendToFile(t *testing.T, file string, s string) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoLogFileVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "app.log")
+	appendToFile(t, log, "2016-03-07 09:00:00 ERROR old error\n")
+
+	zero := 0
+	var c logFileConfiguration
+	c.Path = filepath.Join(dir, "*.log*")
+	c.Pattern = "ERROR"
+	c.NotificationMessage = "An error in the logs"
+	c.MatchesEqual = &zero
+
+	offsets := make(logFileOffsets)
+
+	// the first run starts at the end of the existing files
+	errors := doLogFileVerification(c, offsets)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	appendToFile(t, log, "2016-03-07 10:00:00 INFO started\n2016-03-07 10:00:01 ERROR new error\n2016-03-07 10:00:02 ERROR partial")
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("An error in the logs", errors[0].title)
+	assert.Equal(log+": 2016-03-07 10:00:01 ERROR new error\n", errors[0].message)
+
+	// nothing new, the partial line isn't complete yet
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	appendToFile(t, log, " line\n")
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal(log+": 2016-03-07 10:00:02 ERROR partial line\n", errors[0].message)
+
+	// rotation: the lines written before the rename are read from the rotated file and the
+	// new file is read from the start
+	appendToFile(t, log, "2016-03-07 10:01:00 ERROR before rotation\n")
+	err = os.Rename(log, log+".1")
+	assert.Nil(err, fmt.Sprint(err))
+	appendToFile(t, log, "2016-03-07 10:01:01 ERROR after rotation\n")
+
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal(log+": 2016-03-07 10:01:01 ERROR after rotation\n", errors[0].message)
+	assert.Equal(log+".1: 2016-03-07 10:01:00 ERROR before rotation\n", errors[1].message)
+
+	// compressed rotated files are left alone
+	err = ioutil.WriteFile(log+".2.gz", []byte("\x1f\x8b ERROR\n"), 0644)
+	assert.Nil(err, fmt.Sprint(err))
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	// truncation
+	err = ioutil.WriteFile(log, []byte("ERROR\n"), 0644)
+	assert.Nil(err, fmt.Sprint(err))
+
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal(log+": ERROR\n", errors[0].message)
+}
+
+func TestDoLogFileVerificationAtLeast(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "app.log")
+	appendToFile(t, log, "")
+
+	two := 2
+	var c logFileConfiguration
+	c.Path = log
+	c.Pattern = `Upload (done|finished)`
+	c.NotificationMessage = "Not at least 2 uploads"
+	c.MatchesAtLeast = &two
+
+	offsets := make(logFileOffsets)
+	errors := doLogFileVerification(c, offsets)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	appendToFile(t, log, "Upload done\nUpload started\n")
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at least 2 matches but was 1\n", errors[0].message)
+	assert.Equal("One of the matching lines: "+log+": Upload done\n", errors[1].message)
+	assert.Equal("Log file verification error", errors[1].title)
+
+	appendToFile(t, log, "Upload done\nUpload finished\n")
+	errors = doLogFileVerification(c, offsets)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+}
+
+func TestDoLogFileVerifications(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "app.log")
+	appendToFile(t, log, "ERROR before first run\n")
+
+	zero := 0
+	var c logFileConfiguration
+	c.Path = log
+	c.Pattern = "ERROR"
+	c.MatchesEqual = &zero
+
+	var cfg config
+	cfg.LogFiles = []logFileConfiguration{c}
+	cfg.LogFileOffsets = filepath.Join(dir, "offsets.json")
+
+	errors := doLogFileVerifications(cfg)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	// the offsets are persisted between runs
+	offsets, err := loadLogFileOffsets(cfg.LogFileOffsets)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(int64(len("ERROR before first run\n")), offsets[c.key()][log].Offset)
+
+	appendToFile(t, log, "ERROR after first run\n")
+	errors = doLogFileVerifications(cfg)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+
+	errors = doLogFileVerifications(cfg)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+}
+
+func TestValidateLogFileConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	zero := 0
+	var c logFileConfiguration
+	c.Path = "/var/log/*.log"
+	c.Pattern = "ERROR"
+	assert.NotNil(validateLogFileConfiguration(c), "no assertion")
+
+	c.MatchesAtMost = &zero
+	assert.Nil(validateLogFileConfiguration(c))
+
+	c.Pattern = "ERROR("
+	assert.NotNil(validateLogFileConfiguration(c), "invalid pattern")
+
+	c.Pattern = "ERROR"
+	c.Path = "/var/log/[.log"
+	assert.NotNil(validateLogFileConfiguration(c), "invalid glob")
+}
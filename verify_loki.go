@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type lokiConfiguration struct {
+	checkOptions
+	matchAssertion
+	// URL is the base url of loki, e.g. http://localhost:3100
+	URL string `json:"url"`
+	// Query is a LogQL log query, e.g. {job="nginx"} |= "ERROR"
+	Query               string `json:"query"`
+	Minutes             int    `json:"minutes"`
+	Limit               int    `json:"limit"`
+	NotificationMessage string `json:"notification_message"`
+	// HitFields and HitTemplate work as for elk queries. Each log line is given the fields
+	// "@timestamp" and "message" together with the labels of its stream.
+	HitFields   map[string]string `json:"hit_fields"`
+	HitTemplate string            `json:"hit_template"`
+}
+
+// defaultLokiLimit is the default maximum number of log lines fetched. The total number of
+// matches is counted separately and isn't limited by it.
+const defaultLokiLimit = 500
+
+type LokiResponse struct {
+	Status string   `json:"status"`
+	Data   LokiData `json:"data"`
+}
+
+type LokiData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+type LokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type LokiSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+// check identifies the check in alerts unless it's given a name
+func (c lokiConfiguration) check() string {
+	if c.NotificationMessage != "" {
+		return "loki:" + c.NotificationMessage
+	}
+	return "loki:" + c.Query
+}
+
+func validateLokiConfiguration(c lokiConfiguration) error {
+	if c.URL == "" {
+		return fmt.Errorf("loki query '%s' has no url", c.Query)
+	}
+	if c.Query == "" {
+		return fmt.Errorf("loki query has no query")
+	}
+	if c.Minutes <= 0 {
+		return fmt.Errorf("loki query '%s' has no minutes configured", c.Query)
+	}
+	if _, err := newElkHitFormatter(c.HitFields, c.HitTemplate); err != nil {
+		return fmt.Errorf("loki query '%s' has an invalid hit_template: %s", c.Query, fmt.Sprint(err))
+	}
+
+	return c.matchAssertion.validate(fmt.Sprintf("loki query '%s'", c.Query))
+}
+
+func doLokiVerifications(config config) []verificationError {
+	var errors []verificationError
+
+	for _, c := range config.LokiConfiguration {
+		errors = append(errors, c.apply(doLokiVerification(c, time.Now()), c.check())...)
+	}
+
+	return errors
+}
+
+func doLokiVerification(config lokiConfiguration, now time.Time) []verificationError {
+	var errors []verificationError
+
+	formatter, err := newElkHitFormatter(config.HitFields, config.HitTemplate)
+	if err != nil {
+		e := verificationError{title: "Loki verification error", message: fmt.Sprintf("Failed to parse hit template: %s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	total, err := lokiCount(config, now)
+	if err != nil {
+		e := verificationError{title: "Loki verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	matches, err := lokiLines(config, now)
+	if err != nil {
+		e := verificationError{title: "Loki verification error", message: fmt.Sprintf("%s\n", fmt.Sprint(err))}
+		return append(errors, e)
+	}
+
+	// the count and the lines are separate queries, which disagree if lines are ingested or
+	// dropped in between. There may be fewer lines than counted as they are limited, not more,
+	// and some if any are counted.
+	if len(matches) > total || total > 0 && len(matches) == 0 {
+		e := verificationError{title: "Loki verification error", message: fmt.Sprintf("Loki counted %d matching lines but returned %d\n", total, len(matches))}
+		return append(errors, e)
+	}
+
+	return verifyNoOfMatches(config.matchAssertion, total, matches, "Loki verification error", config.NotificationMessage, formatter)
+}
+
+// lokiCount returns the number of lines matching the query in the window ending at now
+func lokiCount(config lokiConfiguration, now time.Time) (int, error) {
+	params := url.Values{}
+	params.Set("query", fmt.Sprintf("sum(count_over_time(%s[%dm]))", config.Query, config.Minutes))
+	params.Set("time", strconv.FormatInt(now.UnixNano(), 10))
+
+	var res LokiResponse
+	err := lokiGet(config.URL, "/loki/api/v1/query", params, &res)
+	if err != nil {
+		return 0, err
+	}
+
+	var samples []LokiSample
+	err = json.Unmarshal(res.Data.Result, &samples)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse loki count: %s", fmt.Sprint(err))
+	}
+
+	// no matching lines gives an empty vector
+	total := 0
+	for _, s := range samples {
+		v, ok := s.Value[1].(string)
+		if !ok {
+			return 0, fmt.Errorf("Unexpected loki sample value: %v", s.Value[1])
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to parse loki sample value: %s", fmt.Sprint(err))
+		}
+		total += int(f)
+	}
+
+	return total, nil
+}
+
+// lokiLines returns the lines matching the query in the window ending at now, newest first
+func lokiLines(config lokiConfiguration, now time.Time) ([]ElkHit, error) {
+	limit := config.Limit
+	if limit <= 0 {
+		limit = defaultLokiLimit
+	}
+
+	params := url.Values{}
+	params.Set("query", config.Query)
+	params.Set("start", strconv.FormatInt(now.Add(time.Duration(-config.Minutes)*time.Minute).UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(now.UnixNano(), 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", "backward")
+
+	var res LokiResponse
+	err := lokiGet(config.URL, "/loki/api/v1/query_range", params, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	var streams []LokiStream
+	err = json.Unmarshal(res.Data.Result, &streams)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse loki streams: %s", fmt.Sprint(err))
+	}
+
+	type line struct {
+		ts  int64
+		hit ElkHit
+	}
+	var lines []line
+	for _, s := range streams {
+		for _, v := range s.Values {
+			ts, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse loki timestamp: %s", fmt.Sprint(err))
+			}
+
+			source := ElkHitSource{}
+			for k, l := range s.Stream {
+				source[k] = l
+			}
+			source["@timestamp"] = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+			source["message"] = v[1]
+
+			lines = append(lines, line{ts, ElkHit{Source: source}})
+		}
+	}
+
+	// streams are returned one after the other, interleave them
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].ts > lines[j].ts })
+
+	var hits []ElkHit
+	for _, l := range lines {
+		hits = append(hits, l.hit)
+	}
+
+	return hits, nil
+}
+
+func lokiGet(baseURL string, path string, params url.Values, res *LokiResponse) error {
+	u := strings.TrimRight(baseURL, "/") + path + "?" + params.Encode()
+
+	resp, err := http.Get(u)
+	if err != nil {
+		return fmt.Errorf("Failed to make loki request: %s", fmt.Sprint(err))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response from loki: %s", fmt.Sprint(err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Loki request failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	err = json.Unmarshal(body, res)
+	if err != nil {
+		return fmt.Errorf("Failed to parse loki response: %s", fmt.Sprint(err))
+	}
+	if res.Status != "success" {
+		return fmt.Errorf("Loki request failed with status '%s'", res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLokiServer(t *testing.T, count string, streams string) *httptest.Server {
+	assert := assert.New(t)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loki/api/v1/query":
+			fmt.Fprint(w, count)
+		case "/loki/api/v1/query_range":
+			assert.Equal("backward", r.URL.Query().Get("direction"))
+			fmt.Fprint(w, streams)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestDoLokiVerification(t *testing.T) {
+	assert := assert.New(t)
+
+	streams, err := ioutil.ReadFile("test/output_loki_streams.json")
+	assert.Nil(err, fmt.Sprint(err))
+	count, err := ioutil.ReadFile("test/output_loki_count.json")
+	assert.Nil(err, fmt.Sprint(err))
+
+	server := newLokiServer(t, string(count), string(streams))
+	defer server.Close()
+
+	now := time.Unix(1457344800, 0)
+	zero := 0
+	var c lokiConfiguration
+	c.URL = server.URL + "/"
+	c.Query = `{job="docker"} |= "ERROR"`
+	c.Minutes = 5
+	c.NotificationMessage = "An error in the logs the last 5 minutes"
+	c.MatchesEqual = &zero
+	c.HitFields = map[string]string{"DockerName": "container"}
+
+	errors := doLokiVerification(c, now)
+	assert.Equal(3, len(errors), fmt.Sprint(errors))
+	assert.Equal("An error in the logs the last 5 minutes", errors[0].title)
+	// lines from both streams, newest first
+	assert.Equal("2016-03-07T09:59:58Z jenkins ERROR build failed\n", errors[0].message)
+	assert.Equal("2016-03-07T09:59:57.5Z nginx ERROR upstream timed out\n", errors[1].message)
+	assert.Equal("2016-03-07T09:59:55Z jenkins ERROR connection refused\n", errors[2].message)
+
+	// the total comes from the count query, not from the number of lines fetched
+	atLeast := 5
+	c.MatchesEqual = nil
+	c.MatchesAtLeast = &atLeast
+	errors = doLokiVerification(c, now)
+	assert.Equal(2, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected at least 5 matches but was 4\n", errors[0].message)
+
+	atLeast = 4
+	errors = doLokiVerification(c, now)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	// lines counted but not returned, or returned but not counted, are reported as such
+	mismatch := newLokiServer(t, string(count), `{"status":"success","data":{"resultType":"streams","result":[]}}`)
+	defer mismatch.Close()
+	c.URL = mismatch.URL
+	errors = doLokiVerification(c, now)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Loki verification error", errors[0].title)
+	assert.Equal("Loki counted 4 matching lines but returned 0\n", errors[0].message)
+
+	mismatch = newLokiServer(t, `{"status":"success","data":{"resultType":"vector","result":[]}}`, string(streams))
+	defer mismatch.Close()
+	c.URL = mismatch.URL
+	errors = doLokiVerification(c, now)
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Loki counted 0 matching lines but returned 3\n", errors[0].message)
+}
+
+func TestDoLokiVerificationWithNoMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newLokiServer(t,
+		`{"status":"success","data":{"resultType":"vector","result":[]}}`,
+		`{"status":"success","data":{"resultType":"streams","result":[]}}`)
+	defer server.Close()
+
+	zero := 0
+	var c lokiConfiguration
+	c.URL = server.URL
+	c.Query = `{job="docker"} |= "ERROR"`
+	c.Minutes = 5
+	c.NotificationMessage = "msg"
+	c.MatchesEqual = &zero
+
+	errors := doLokiVerification(c, time.Now())
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+
+	one := 1
+	c.MatchesEqual = &one
+	errors = doLokiVerification(c, time.Now())
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Expected 1 matches but was 0\n", errors[0].message)
+}
+
+func TestLokiRequestParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1457344800, 0)
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/loki/api/v1/query":
+			queries = append(queries, q.Get("query"))
+			assert.Equal(strconv.FormatInt(now.UnixNano(), 10), q.Get("time"))
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+		case "/loki/api/v1/query_range":
+			queries = append(queries, q.Get("query"))
+			assert.Equal(strconv.FormatInt(now.Add(-10*time.Minute).UnixNano(), 10), q.Get("start"))
+			assert.Equal(strconv.FormatInt(now.UnixNano(), 10), q.Get("end"))
+			assert.Equal("500", q.Get("limit"))
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"streams","result":[]}}`)
+		}
+	}))
+	defer server.Close()
+
+	zero := 0
+	var c lokiConfiguration
+	c.URL = server.URL
+	c.Query = `{job="docker"} |= "ERROR"`
+	c.Minutes = 10
+	c.MatchesEqual = &zero
+
+	errors := doLokiVerification(c, now)
+	assert.Equal(0, len(errors), fmt.Sprint(errors))
+	assert.Equal([]string{`sum(count_over_time({job="docker"} |= "ERROR"[10m]))`, `{job="docker"} |= "ERROR"`}, queries)
+}
+
+func TestDoLokiVerificationFailingRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "parse error at line 1, col 1: syntax error", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	zero := 0
+	var c lokiConfiguration
+	c.URL = server.URL
+	c.Query = `job="docker"`
+	c.Minutes = 5
+	c.MatchesEqual = &zero
+
+	errors := doLokiVerification(c, time.Now())
+	assert.Equal(1, len(errors), fmt.Sprint(errors))
+	assert.Equal("Loki verification error", errors[0].title)
+	assert.Equal("Loki request failed with status 400: parse error at line 1, col 1: syntax error\n", errors[0].message)
+}
+
+func TestValidateLokiConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	zero := 0
+	var c lokiConfiguration
+	c.URL = "http://localhost:3100"
+	c.Query = `{job="docker"}`
+	c.Minutes = 5
+	assert.NotNil(validateLokiConfiguration(c), "no assertion")
+
+	c.MatchesEqual = &zero
+	assert.Nil(validateLokiConfiguration(c))
+
+	c.HitTemplate = "{{.Message"
+	assert.NotNil(validateLokiConfiguration(c), "invalid hit template")
+	c.HitTemplate = ""
+
+	c.MatchesAtMost = &zero
+	assert.NotNil(validateLokiConfiguration(c), "two assertions")
+
+	c.MatchesAtMost = nil
+	c.URL = ""
+	assert.NotNil(validateLokiConfiguration(c), "no url")
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/mail"
 	"net/smtp"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -51,7 +57,7 @@ func TestSendEmail(t *testing.T) {
 	parsedTime, err := time.Parse(rfc2822, tt)
 	assert.Nil(err, fmt.Sprint(err))
 
-	err = sendEmail(m.MockSender, cfg, parsedTime, errors)
+	err = sendEmail(m.MockSender, cfg, nil, parsedTime, errors)
 	assert.Nil(err, fmt.Sprint(err))
 
 	assert.Equal("host:6666", m.addr)
@@ -69,21 +75,232 @@ func TestSendEmail(t *testing.T) {
 	assert.Equal("Sun, 28 Feb 2016 18:54:05 +0100", header.Get("Date"))
 	assert.Equal("<from@>", header.Get("From"))
 	assert.Equal("<to1@>, <to2@>", header.Get("To"))
-	assert.Equal("Ismonitor alert", header.Get("Subject"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("[ismonitor] "+hostname()+": 1 warning — Title", subject)
 	assert.Equal("1.0", header.Get("MIME-Version"))
-	assert.Equal("text/plain; charset=\"utf-8\"", header.Get("Content-Type"))
-	assert.Equal("base64", header.Get("Content-Transfer-Encoding"))
-
-	body, err := ioutil.ReadAll(mm.Body)
-	assert.Nil(err)
-	// decode the base64 encoded body
-	decodedStr := make([]byte, base64.StdEncoding.DecodedLen(len(body)))
-	len, err := base64.StdEncoding.Decode(decodedStr, body)
-	assert.Nil(err)
-	// DecodedLen returns the maximal length.
-	// This length is useful for sizing your buffer but part of the buffer won't be
-	// written and thus won't be valid UTF-8.
-	// You have to use only the real written length returned by the Decode function.
-	// Hence the [:len] below
-	assert.Equal("Title\n   Error1\n", string(decodedStr[:len]))
+	assert.Regexp(`^<\d+\.[0-9a-f]{16}@`, header.Get("Message-ID"))
+
+	// the headers are always in the same order
+	assert.True(strings.HasPrefix(m.msg, "Date: Sun, 28 Feb 2016 18:54:05 +0100\r\nFrom: <from@>\r\nTo: <to1@>, <to2@>\r\nSubject: =?utf-8?q?"), m.msg)
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("multipart/alternative", mediaType)
+
+	mr := multipart.NewReader(mm.Body, params["boundary"])
+
+	part, err := mr.NextPart()
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("text/plain; charset=\"utf-8\"", part.Header.Get("Content-Type"))
+	assert.Equal("base64", part.Header.Get("Content-Transfer-Encoding"))
+	assert.Equal("Title\n   Error1\n", readBase64Part(t, part))
+
+	part, err = mr.NextPart()
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("text/html; charset=\"utf-8\"", part.Header.Get("Content-Type"))
+	html := readBase64Part(t, part)
+	assert.Contains(html, "<th colspan=\"2\" style=\"text-align: left; border-bottom: 2px solid #ffa500;\">Title</th>")
+	assert.Contains(html, ">Error1</pre>")
+
+	_, err = mr.NextPart()
+	assert.Equal(io.EOF, err)
+}
+
+func readBase64Part(t *testing.T, r io.Reader) string {
+	b, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMakeMail(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := time.Date(2016, 2, 28, 18, 54, 5, 0, time.UTC)
+	headers := makeHeaders("<from@example.com>", "<to@example.com>", "Diskanvändning på webb-01", ts, makeMessageID(ts, "from@example.com"), "")
+
+	errors := []verificationError{
+		{title: "Docker verification error", message: "Docker container '<nginx>' is not running\n", severity: severityCritical},
+		{title: "Disk usage verification error", message: strings.Repeat("Disk usage of / at 92 percent\n", 10), severity: severityWarning},
+	}
+	parts, err := makeMailParts("", makeAlertTemplateData(errors, ts), errors)
+	assert.Nil(err, fmt.Sprint(err))
+	b, err := makeMail(headers, parts)
+	assert.Nil(err, fmt.Sprint(err))
+
+	mm, err := mail.ReadMessage(bytes.NewReader(b))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("=?utf-8?q?Diskanv=C3=A4ndning_p=C3=A5_webb-01?=", mm.Header.Get("Subject"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(mm.Header.Get("Subject"))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("Diskanvändning på webb-01", subject)
+	assert.Regexp(`^<1456685645000000000\.[0-9a-f]{16}@example\.com>$`, mm.Header.Get("Message-ID"))
+
+	// base64 in lines of at most 76 characters
+	for _, l := range strings.Split(strings.SplitN(string(b), "\r\n\r\n", 2)[1], "\r\n") {
+		assert.True(len(l) <= 78, l)
+	}
+
+	_, params, err := mime.ParseMediaType(mm.Header.Get("Content-Type"))
+	assert.Nil(err, fmt.Sprint(err))
+	mr := multipart.NewReader(mm.Body, params["boundary"])
+	_, err = mr.NextPart()
+	assert.Nil(err, fmt.Sprint(err))
+	part, err := mr.NextPart()
+	assert.Nil(err, fmt.Sprint(err))
+
+	html := readBase64Part(t, part)
+	assert.Contains(html, "Docker container &#39;&lt;nginx&gt;&#39; is not running")
+	assert.Contains(html, "background-color: #d00000;\">critical</td>")
+	assert.Contains(html, "background-color: #ffa500;\">warning</td>")
+}
+
+func TestMailTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := time.Date(2016, 2, 28, 18, 54, 5, 0, time.UTC)
+	errors := []verificationError{
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityCritical, check: "disk:/"},
+		{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"},
+		{title: "Disk usage verification error", message: "Disk usage of / at 92 percent\n", severity: severityWarning, check: "disk:/"},
+	}
+	data := makeAlertTemplateData(errors, ts)
+
+	subject, err := makeMailSubject("", defaultMailSubject, data)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("[ismonitor] "+hostname()+": 2 critical, 1 warning — disk /, docker nginx", subject)
+
+	subject, err = makeMailSubject("", defaultMailSubject, makeAlertTemplateData(errors[1:2], ts))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("[ismonitor] "+hostname()+": 1 critical — docker nginx", subject)
+
+	subject, err = makeMailSubject("{{.Hostname | upper}}\n{{.Timestamp.Format \"15:04\"}} {{range .Groups}}{{.Title}} {{end}}", defaultMailSubject, data)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(strings.ToUpper(hostname())+" 18:54 Disk usage verification error Docker verification error", subject, "a single line")
+
+	subject, err = makeMailSubject(strings.Repeat("x", 300), defaultMailSubject, data)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(maxMailSubjectLength, len([]rune(subject)))
+
+	_, err = makeMailSubject("{{.Nonexistent}}", defaultMailSubject, data)
+	assert.NotNil(err)
+
+	// a body template replaces both the text and html versions
+	parts, err := makeMailParts("{{range .Errors}}* {{.Message}}\n{{end}}", data, errors)
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(1, len(parts))
+	assert.Equal("* Disk usage of / at 92 percent\n* Docker container 'nginx' is not running\n* Disk usage of / at 92 percent\n", parts[0].content)
+
+	b, err := makeMail(makeHeaders("<from@example.com>", "<to@example.com>", subject, ts, "<id@example.com>", ""), parts)
+	assert.Nil(err, fmt.Sprint(err))
+	mm, err := mail.ReadMessage(bytes.NewReader(b))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("text/plain; charset=\"utf-8\"", mm.Header.Get("Content-Type"))
+	assert.Equal(parts[0].content, readBase64Part(t, mm.Body))
+
+	assert.NotNil(validateSMTPConfiguration(smtpConfiguration{Host: "host", To: []string{"to"}, Subject: "{{.Hostname"}), "invalid subject template")
+	assert.NotNil(validateSMTPConfiguration(smtpConfiguration{Host: "host", To: []string{"to"}, Body: "{{end}}"}), "invalid body template")
+}
+
+func TestMailThreading(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := smtpConfiguration{Host: "host", Port: 25, From: "ismonitor@example.com", To: []string{"ops@example.com"}}
+	ts := time.Date(2016, 2, 28, 18, 54, 5, 0, time.UTC)
+	thread := "<incident.1456685645000000000." + syslogHeaderField(hostname()) + "@example.com>"
+
+	send := func(errors []verificationError, recovery bool) *mail.Message {
+		var m mockSender
+		var err error
+		if recovery {
+			err = sendRecoveryEmail(m.MockSender, cfg, nil, ts, errors)
+		} else {
+			err = sendEmail(m.MockSender, cfg, nil, ts, errors)
+		}
+		assert.Nil(err, fmt.Sprint(err))
+		mm, err := mail.ReadMessage(strings.NewReader(m.msg))
+		assert.Nil(err, fmt.Sprint(err))
+		return mm
+	}
+
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+
+	// the first mail of an incident starts the thread
+	errors[0].incident = incidentRef{id: "1456685645000000000", opened: true}
+	mm := send(errors, false)
+	assert.Equal(thread, mm.Header.Get("Message-ID"))
+	assert.Equal("", mm.Header.Get("In-Reply-To"))
+	assert.Equal("", mm.Header.Get("References"))
+
+	// the following are replies to it
+	errors[0].incident = incidentRef{id: "1456685645000000000"}
+	mm = send(errors, false)
+	assert.NotEqual(thread, mm.Header.Get("Message-ID"))
+	assert.Equal(thread, mm.Header.Get("In-Reply-To"))
+	assert.Equal(thread, mm.Header.Get("References"))
+
+	// as is the recovery
+	errors[0].incident = incidentRef{id: "1456685645000000000", closed: true}
+	mm = send(errors, true)
+	assert.Equal(thread, mm.Header.Get("In-Reply-To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(mm.Header.Get("Subject"))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal("[ismonitor] "+hostname()+": recovered — docker nginx", subject)
+	assert.Equal("Recovered:\nDocker verification error\n   docker nginx\n\nAll checks are passing again.\n", readBase64Part(t, mm.Body))
+
+	// without an incident there is no thread
+	errors[0].incident = incidentRef{}
+	mm = send(errors, false)
+	assert.Equal("", mm.Header.Get("In-Reply-To"))
+}
+
+func TestMailThreadingState(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ismonitor")
+	assert.Nil(err, fmt.Sprint(err))
+	defer os.RemoveAll(dir)
+	threads := &mailThreads{filepath.Join(dir, "alert_state.json")}
+
+	cfg := smtpConfiguration{Host: "host", Port: 25, From: "ismonitor@example.com", To: []string{"ops@example.com"}}
+	ts := time.Date(2016, 2, 28, 18, 54, 5, 0, time.UTC)
+	thread := "<incident.1456685645000000000." + syslogHeaderField(hostname()) + "@example.com>"
+
+	errors := []verificationError{{title: "Docker verification error", message: "Docker container 'nginx' is not running\n", severity: severityCritical, check: "docker:nginx"}}
+	errors[0].incident = incidentRef{id: "1456685645000000000", opened: true}
+
+	// a mail that fails to be sent doesn't start the thread
+	failing := func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return fmt.Errorf("connection refused")
+	}
+	err = sendEmail(failing, cfg, threads, ts, errors)
+	assert.NotNil(err)
+	assert.False(threads.started(thread))
+
+	// so the next one does, even though the incident opened before it
+	errors[0].incident = incidentRef{id: "1456685645000000000"}
+	var m mockSender
+	err = sendEmail(m.MockSender, cfg, threads, ts, errors)
+	assert.Nil(err, fmt.Sprint(err))
+	mm, err := mail.ReadMessage(strings.NewReader(m.msg))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.Equal(thread, mm.Header.Get("Message-ID"))
+	assert.Equal("", mm.Header.Get("In-Reply-To"))
+	assert.True(threads.started(thread))
+
+	// and the ones after it are replies
+	err = sendEmail(m.MockSender, cfg, threads, ts, errors)
+	assert.Nil(err, fmt.Sprint(err))
+	mm, err = mail.ReadMessage(strings.NewReader(m.msg))
+	assert.Nil(err, fmt.Sprint(err))
+	assert.NotEqual(thread, mm.Header.Get("Message-ID"))
+	assert.Equal(thread, mm.Header.Get("In-Reply-To"))
+
+	// a new incident starts over
+	state, err := loadAlertState(threads.file)
+	assert.Nil(err, fmt.Sprint(err))
+	state.update(errors, ts.Add(time.Minute), nil)
+	assert.Nil(state.Threads)
 }
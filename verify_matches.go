@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+)
+
+// matchAssertion is the assertion on the number of matches of a log query.
+// Exactly one of the fields is expected to be set.
+type matchAssertion struct {
+	MatchesEqual   *int        `json:"matchesEquals"`
+	MatchesAtLeast *int        `json:"matchesAtLeast"`
+	MatchesAtMost  *int        `json:"matchesAtMost"`
+	MatchesBetween *matchRange `json:"matchesBetween"`
+}
+
+// matchRange is an inclusive range of number of matches
+type matchRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// count returns the number of assertions that are set
+func (a matchAssertion) count() int {
+	n := 0
+	if a.MatchesEqual != nil {
+		n++
+	}
+	if a.MatchesAtLeast != nil {
+		n++
+	}
+	if a.MatchesAtMost != nil {
+		n++
+	}
+	if a.MatchesBetween != nil {
+		n++
+	}
+	return n
+}
+
+// validate verifies that exactly one assertion is set and that it is well formed. what names
+// the check in the errors, e.g. loki query 'rate(...)'.
+func (a matchAssertion) validate(what string) error {
+	n := a.count()
+	if n == 0 {
+		return fmt.Errorf("%s has no assertion, expected one of matchesEquals, matchesAtLeast, matchesAtMost or matchesBetween", what)
+	}
+	if n > 1 {
+		return fmt.Errorf("%s has more than one assertion, expected only one of matchesEquals, matchesAtLeast, matchesAtMost or matchesBetween", what)
+	}
+	if a.MatchesBetween != nil && a.MatchesBetween.Min > a.MatchesBetween.Max {
+		return fmt.Errorf("%s has matchesBetween with min %d larger than max %d", what, a.MatchesBetween.Min, a.MatchesBetween.Max)
+	}
+	return nil
+}
+
+// verifyNoOfMatches applies the configured assertion to the result of a log query. The matches
+// are used to show the offending lines in the alert and may be fewer than total. title is that
+// of the errors of the backend, e.g. Loki verification error.
+func verifyNoOfMatches(assertion matchAssertion, total int, matches []ElkHit, title string, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	switch {
+	case assertion.MatchesEqual != nil:
+		return verifyExpectedNoOfMatches(total, matches, *assertion.MatchesEqual, notificationMessage, formatter)
+	case assertion.MatchesAtLeast != nil:
+		return verifyAtLeastNoOfMatches(total, matches, *assertion.MatchesAtLeast, title, notificationMessage, formatter)
+	case assertion.MatchesAtMost != nil:
+		return verifyAtMostNoOfMatches(total, matches, *assertion.MatchesAtMost, notificationMessage, formatter)
+	case assertion.MatchesBetween != nil:
+		return verifyNoOfMatchesBetween(total, matches, *assertion.MatchesBetween, notificationMessage, formatter)
+	default:
+		e := verificationError{title: notificationMessage, message: "No assertion configured\n"}
+		return []verificationError{e}
+	}
+}
+
+func verifyExpectedNoOfMatches(total int, matches []ElkHit, expectedMatches int, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	var errors []verificationError
+
+	if total != expectedMatches {
+		if total == 0 {
+			e := verificationError{title: notificationMessage, message: fmt.Sprintf("Expected %d matches but was 0\n", expectedMatches)}
+			errors = append(errors, e)
+		} else {
+			for _, hit := range matches {
+				e := verificationError{title: notificationMessage, message: fmt.Sprintf("%s\n", formatter.format(hit))}
+				errors = append(errors, e)
+			}
+		}
+	}
+
+	return errors
+}
+
+func verifyAtLeastNoOfMatches(total int, matches []ElkHit, atleast int, title string, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	var errors []verificationError
+
+	if total < atleast {
+		e := verificationError{title: notificationMessage, message: fmt.Sprintf("Expected at least %d matches but was %d\n", atleast, total)}
+		errors = append(errors, e)
+		if len(matches) > 0 {
+			e := verificationError{
+				title:   title,
+				message: fmt.Sprintf("One of the matching lines: %s\n", formatter.format(matches[0]))}
+			errors = append(errors, e)
+		}
+	}
+
+	return errors
+}
+
+func verifyAtMostNoOfMatches(total int, matches []ElkHit, atmost int, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	var errors []verificationError
+
+	if total > atmost {
+		e := verificationError{title: notificationMessage, message: fmt.Sprintf("Expected at most %d matches but was %d\n", atmost, total)}
+		errors = append(errors, e)
+		for _, hit := range matches {
+			e := verificationError{title: notificationMessage, message: fmt.Sprintf("%s\n", formatter.format(hit))}
+			errors = append(errors, e)
+		}
+	}
+
+	return errors
+}
+
+func verifyNoOfMatchesBetween(total int, matches []ElkHit, between matchRange, notificationMessage string, formatter *elkHitFormatter) []verificationError {
+	var errors []verificationError
+
+	if total < between.Min || total > between.Max {
+		e := verificationError{
+			title:   notificationMessage,
+			message: fmt.Sprintf("Expected between %d and %d matches but was %d\n", between.Min, between.Max, total)}
+		errors = append(errors, e)
+		if total > between.Max {
+			for _, hit := range matches {
+				e := verificationError{title: notificationMessage, message: fmt.Sprintf("%s\n", formatter.format(hit))}
+				errors = append(errors, e)
+			}
+		} else if len(matches) > 0 {
+			e := verificationError{title: notificationMessage, message: fmt.Sprintf("One of the matching lines: %s\n", formatter.format(matches[0]))}
+			errors = append(errors, e)
+		}
+	}
+
+	return errors
+}
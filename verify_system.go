@@ -17,13 +17,14 @@ func verifyFreeSpace(output string, diskUsagePercentWarning int) []verificationE
 		if len(columns) > 1 {
 			percentValue, err := strconv.Atoi(strings.Trim(columns[1], "%"))
 			if err != nil {
-				e := verificationError{title: "Disk usage verification error", message: fmt.Sprint(err)}
+				e := verificationError{title: "Disk usage verification error", message: fmt.Sprint(err), check: "disk"}
 				errors = append(errors, e)
 			} else {
 				if percentValue >= diskUsagePercentWarning {
 					e := verificationError{
 						title: "Disk usage verification error",
-						message: fmt.Sprintf("Disk usage of %s at %d percent\n", columns[2], percentValue)}
+						message: fmt.Sprintf("Disk usage of %s at %d percent\n", columns[2], percentValue),
+						check: "disk:" + columns[2]}
 					errors = append(errors, e)
 				}
 			}
@@ -41,11 +42,11 @@ func verifyLoadAvg(output string, uptimeLoad5MinutesWarning float64) []verificat
 	if len(columns) >= 3 {
 		floatValue, err := strconv.ParseFloat(columns[1], 64)
 		if err != nil {
-			e := verificationError{title: "Load average verification error", message: fmt.Sprint(err)}
+			e := verificationError{title: "Load average verification error", message: fmt.Sprint(err), check: "load"}
 			errors = append(errors, e)
 		} else {
 			if floatValue >= uptimeLoad5MinutesWarning {
-				e := verificationError{title: "Load average verification error", message: fmt.Sprintf("High load warning: %s\n", output)}
+				e := verificationError{title: "Load average verification error", message: fmt.Sprintf("High load warning: %s\n", output), check: "load"}
 				errors = append(errors, e)
 			}
 		}